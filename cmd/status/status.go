@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/noisysockets/nsh/internal/control"
+	"gopkg.in/yaml.v3"
+)
+
+// Status queries the control API of a running `nsh up` process and prints
+// the status of the network and its peers in the requested output format.
+func Status(ctx context.Context, controlSocketPath, output string, probe bool) error {
+	status, err := control.NewClient(controlSocketPath).Status(ctx, probe)
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(status); err != nil {
+			return fmt.Errorf("failed to encode status: %w", err)
+		}
+	case "yaml":
+		enc := yaml.NewEncoder(os.Stdout)
+		defer enc.Close()
+
+		if err := enc.Encode(status); err != nil {
+			return fmt.Errorf("failed to encode status: %w", err)
+		}
+	case "table", "":
+		if err := writeTable(os.Stdout, status); err != nil {
+			return fmt.Errorf("failed to write status: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported output format %q", output)
+	}
+
+	return nil
+}
+
+func writeTable(w io.Writer, status *control.Status) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Name:\t%s\n", status.Name)
+	fmt.Fprintf(tw, "Public Key:\t%s\n", status.PublicKey)
+	fmt.Fprintf(tw, "Listen Port:\t%d\n", status.ListenPort)
+	fmt.Fprintf(tw, "Domain:\t%s\n", status.Domain)
+	fmt.Fprintf(tw, "IPs:\t%s\n", join(status.IPs))
+	fmt.Fprintf(tw, "Uptime:\t%s\n", time.Since(status.StartedAt).Truncate(time.Second))
+	fmt.Fprintf(tw, "Services:\t%s\n", strings.Join(status.Services, ","))
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(status.Peers) > 0 {
+		fmt.Fprintln(w)
+
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tPUBLIC KEY\tCONFIGURED ENDPOINT\tALLOWED IPS\tPROBE REACHABLE\tPROBE RTT")
+
+		for _, peer := range status.Peers {
+			reachable, rtt := "-", "-"
+			if peer.Reachable != nil {
+				reachable = fmt.Sprintf("%t", *peer.Reachable)
+				if *peer.Reachable {
+					rtt = peer.RTT.Round(time.Microsecond).String()
+				}
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				orDash(peer.Name), peer.PublicKey, orDash(peer.ConfiguredEndpoint),
+				orDash(join(peer.AllowedIPs)), reachable, rtt)
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(status.Routes) > 0 {
+		fmt.Fprintln(w)
+
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DESTINATION\tVIA")
+
+		for _, route := range status.Routes {
+			fmt.Fprintf(tw, "%s\t%s\n", route.Destination, route.Via)
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func join[T fmt.Stringer](values []T) string {
+	var strs []string
+	for _, v := range values {
+		strs = append(strs, v.String())
+	}
+
+	return strings.Join(strs, ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
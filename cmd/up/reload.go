@@ -0,0 +1,412 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package up
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config"
+	configtypes "github.com/noisysockets/noisysockets/config/types"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	"github.com/noisysockets/noisysockets/types"
+	"github.com/noisysockets/nsh/internal/service"
+)
+
+// How long to wait for a burst of file system events to settle before
+// reloading the config.
+const watchDebounce = 500 * time.Millisecond
+
+// reloader applies configuration changes to a running network.
+type reloader struct {
+	configPath string
+	net        *noisysockets.NoisySocketsNetwork
+	services   []service.Service
+	mu         sync.RWMutex
+	conf       *latestconfig.Config
+}
+
+func newReloader(configPath string, net *noisysockets.NoisySocketsNetwork,
+	conf *latestconfig.Config, services []service.Service) *reloader {
+	return &reloader{
+		configPath: configPath,
+		net:        net,
+		services:   services,
+		conf:       conf,
+	}
+}
+
+// Config returns the currently active config.
+func (r *reloader) Config() *latestconfig.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.conf
+}
+
+// Run reloads the config whenever a SIGHUP is received, or if watch is true,
+// whenever the config file changes.
+func (r *reloader) Run(ctx context.Context, hup <-chan os.Signal, watch bool) error {
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+
+	if watch {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("failed to create config watcher: %w", err)
+		}
+		defer watcher.Close()
+
+		// Watch the parent directory as the config file is replaced on update.
+		if err := watcher.Add(filepath.Dir(r.configPath)); err != nil {
+			return fmt.Errorf("failed to watch config directory: %w", err)
+		}
+
+		slog.Info("Watching config file for changes", slog.String("path", r.configPath))
+
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config")
+
+			r.reload()
+		case event := <-events:
+			if filepath.Clean(event.Name) != filepath.Clean(r.configPath) ||
+				!event.Has(fsnotify.Create|fsnotify.Write|fsnotify.Rename) {
+				continue
+			}
+
+			debounce.Reset(watchDebounce)
+		case <-debounce.C:
+			slog.Info("Config file changed, reloading config")
+
+			r.reload()
+		case err := <-errs:
+			slog.Warn("Error watching config file", slog.Any("error", err))
+		}
+	}
+}
+
+func (r *reloader) reload() {
+	newConf, err := readConfig(r.configPath)
+	if err != nil {
+		slog.Error("Failed to reload config", slog.Any("error", err))
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Only the changes that were actually applied are committed, so that any
+	// failed changes are retried on the next reload.
+	appliedConf, err := applyConfig(r.net, r.conf, newConf)
+	if err != nil {
+		slog.Error("Failed to apply some config changes", slog.Any("error", err))
+	}
+
+	r.conf = appliedConf
+
+	for _, s := range r.services {
+		if c, ok := s.(service.Configurable); ok {
+			c.SetConfig(appliedConf)
+		}
+	}
+}
+
+// liveNetwork is a running network that config changes can be applied to.
+type liveNetwork interface {
+	AddPeer(peerConf latestconfig.PeerConfig) error
+	RemovePeer(publicKey types.NoisePublicKey)
+	AddRoute(routeConf latestconfig.RouteConfig) error
+	RemoveRoute(destination netip.Prefix) error
+}
+
+var _ liveNetwork = (*noisysockets.NoisySocketsNetwork)(nil)
+
+// applyConfig incrementally applies the differences between the old and new
+// configs to the running network. It returns the config that is now in effect,
+// which keeps the old values for anything that couldn't be applied.
+func applyConfig(net liveNetwork, oldConf, newConf *latestconfig.Config) (*latestconfig.Config, error) {
+	appliedConf := *newConf
+
+	if oldConf.PrivateKey != newConf.PrivateKey ||
+		oldConf.ListenPort != newConf.ListenPort ||
+		oldConf.Name != newConf.Name ||
+		oldConf.MTU != newConf.MTU ||
+		!reflect.DeepEqual(oldConf.Subnet, newConf.Subnet) ||
+		!slices.Equal(oldConf.IPs, newConf.IPs) {
+		slog.Warn("Interface config changed, a restart is required to apply these changes")
+
+		appliedConf.PrivateKey = oldConf.PrivateKey
+		appliedConf.ListenPort = oldConf.ListenPort
+		appliedConf.Name = oldConf.Name
+		appliedConf.MTU = oldConf.MTU
+		appliedConf.Subnet = oldConf.Subnet
+		appliedConf.IPs = oldConf.IPs
+	}
+
+	// DNS changes are passed on to the services (eg. the DNS service), but the
+	// network domain is fixed when the network is created.
+	if !reflect.DeepEqual(oldConf.DNS, newConf.DNS) {
+		var dnsConf latestconfig.DNSConfig
+		if newConf.DNS != nil {
+			dnsConf = *newConf.DNS
+		}
+
+		if oldDomain := dnsDomain(oldConf); dnsConf.Domain != oldDomain {
+			slog.Warn("DNS domain changed, a restart is required to apply this change")
+
+			dnsConf.Domain = oldDomain
+		}
+
+		appliedConf.DNS = &dnsConf
+		if reflect.DeepEqual(dnsConf, latestconfig.DNSConfig{}) {
+			appliedConf.DNS = nil
+		}
+
+		if !reflect.DeepEqual(appliedConf.DNS, oldConf.DNS) {
+			slog.Info("Updating DNS config")
+		}
+	}
+
+	var errs []error
+
+	oldPeers := peersByPublicKey(oldConf)
+	newPeers := peersByPublicKey(newConf)
+
+	// Peers that will be removed (or replaced) along with all of their routes.
+	replacedPeers := make(map[string]bool)
+	// Peers that are still live with their old config.
+	keptPeers := make(map[string]latestconfig.PeerConfig)
+	// Peers that failed to be added.
+	failedPeers := make(map[string]bool)
+
+	for publicKey, oldPeerConf := range oldPeers {
+		newPeerConf, ok := newPeers[publicKey]
+		if ok && reflect.DeepEqual(oldPeerConf, newPeerConf) {
+			continue
+		}
+
+		var pk types.NoisePublicKey
+		if err := pk.UnmarshalText([]byte(publicKey)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid peer public key %q: %w", publicKey, err))
+			keptPeers[publicKey] = oldPeerConf
+			continue
+		}
+
+		if ok {
+			slog.Info("Updating peer", slog.String("name", newPeerConf.Name), slog.String("peer", publicKey))
+		} else {
+			slog.Info("Removing peer", slog.String("name", oldPeerConf.Name), slog.String("peer", publicKey))
+		}
+
+		net.RemovePeer(pk)
+		replacedPeers[publicKey] = true
+	}
+
+	// Remove routes that are no longer present, or that now use a different
+	// gateway. Routes via removed peers have already been removed.
+	oldRoutes := routesByDestination(oldConf)
+	newRoutes := routesByDestination(newConf)
+
+	// Routes that are still live with their old config.
+	keptRoutes := make(map[string]latestconfig.RouteConfig)
+	// Routes that failed to be added.
+	failedRoutes := make(map[string]bool)
+
+	for destination, oldRouteConf := range oldRoutes {
+		oldVia, ok := lookupPeer(oldConf, oldRouteConf.Via)
+		if !ok || replacedPeers[oldVia] {
+			continue
+		}
+
+		newRouteConf, ok := newRoutes[destination]
+		if ok && oldVia == viaPublicKey(newConf, newRouteConf.Via) {
+			continue
+		}
+
+		slog.Info("Removing route", slog.String("destination", destination), slog.String("via", oldRouteConf.Via))
+
+		if err := net.RemoveRoute(oldRouteConf.Destination); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove route %s: %w", destination, err))
+			keptRoutes[destination] = oldRouteConf
+		}
+	}
+
+	for _, newPeerConf := range newConf.Peers {
+		if _, ok := oldPeers[newPeerConf.PublicKey]; ok && !replacedPeers[newPeerConf.PublicKey] {
+			continue
+		}
+
+		if _, ok := oldPeers[newPeerConf.PublicKey]; !ok {
+			slog.Info("Adding peer", slog.String("name", newPeerConf.Name), slog.String("peer", newPeerConf.PublicKey))
+		}
+
+		if err := net.AddPeer(newPeerConf); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add peer %q: %w", newPeerConf.PublicKey, err))
+			failedPeers[newPeerConf.PublicKey] = true
+		}
+	}
+
+	// Add new routes, changed routes, and routes via replaced peers.
+	for _, newRouteConf := range newConf.Routes {
+		destination := newRouteConf.Destination.String()
+
+		// The old route couldn't be removed.
+		if _, ok := keptRoutes[destination]; ok {
+			continue
+		}
+
+		oldRouteConf, ok := oldRoutes[destination]
+		if ok && !replacedPeers[viaPublicKey(newConf, newRouteConf.Via)] &&
+			viaPublicKey(oldConf, oldRouteConf.Via) == viaPublicKey(newConf, newRouteConf.Via) {
+			continue
+		}
+
+		if !ok || viaPublicKey(oldConf, oldRouteConf.Via) != viaPublicKey(newConf, newRouteConf.Via) {
+			slog.Info("Adding route", slog.String("destination", destination), slog.String("via", newRouteConf.Via))
+		}
+
+		if err := net.AddRoute(newRouteConf); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add route %s: %w", destination, err))
+			failedRoutes[destination] = true
+		}
+	}
+
+	appliedConf.Peers = nil
+	for _, newPeerConf := range newConf.Peers {
+		if _, ok := keptPeers[newPeerConf.PublicKey]; ok || failedPeers[newPeerConf.PublicKey] {
+			continue
+		}
+
+		appliedConf.Peers = append(appliedConf.Peers, newPeerConf)
+	}
+	for _, oldPeerConf := range oldConf.Peers {
+		if _, ok := keptPeers[oldPeerConf.PublicKey]; ok {
+			appliedConf.Peers = append(appliedConf.Peers, oldPeerConf)
+		}
+	}
+
+	appliedConf.Routes = nil
+	for _, newRouteConf := range newConf.Routes {
+		destination := newRouteConf.Destination.String()
+		if _, ok := keptRoutes[destination]; ok || failedRoutes[destination] {
+			continue
+		}
+
+		appliedConf.Routes = append(appliedConf.Routes, newRouteConf)
+	}
+	for _, oldRouteConf := range oldConf.Routes {
+		if _, ok := keptRoutes[oldRouteConf.Destination.String()]; ok {
+			appliedConf.Routes = append(appliedConf.Routes, oldRouteConf)
+		}
+	}
+
+	return &appliedConf, errors.Join(errs...)
+}
+
+// readConfig reads the config file and migrates it to the latest version.
+func readConfig(configPath string) (*latestconfig.Config, error) {
+	configFile, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer configFile.Close()
+
+	conf, err := config.FromYAML(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	return toLatest(conf)
+}
+
+func toLatest(conf configtypes.Config) (*latestconfig.Config, error) {
+	conf, err := config.MigrateToLatest(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate config: %w", err)
+	}
+
+	latestConf, ok := conf.(*latestconfig.Config)
+	if !ok {
+		return nil, errors.New("expected config to be automatically migrated to latest version")
+	}
+
+	return latestConf, nil
+}
+
+// dnsDomain returns the configured DNS domain (if any).
+func dnsDomain(conf *latestconfig.Config) string {
+	if conf.DNS == nil {
+		return ""
+	}
+
+	return conf.DNS.Domain
+}
+
+func peersByPublicKey(conf *latestconfig.Config) map[string]latestconfig.PeerConfig {
+	peers := make(map[string]latestconfig.PeerConfig, len(conf.Peers))
+	for _, peerConf := range conf.Peers {
+		peers[peerConf.PublicKey] = peerConf
+	}
+
+	return peers
+}
+
+func routesByDestination(conf *latestconfig.Config) map[string]latestconfig.RouteConfig {
+	routes := make(map[string]latestconfig.RouteConfig, len(conf.Routes))
+	for _, routeConf := range conf.Routes {
+		routes[routeConf.Destination.String()] = routeConf
+	}
+
+	return routes
+}
+
+// viaPublicKey returns the public key of the gateway peer for a route, or the
+// unmodified via value if the peer is unknown.
+func viaPublicKey(conf *latestconfig.Config, via string) string {
+	if publicKey, ok := lookupPeer(conf, via); ok {
+		return publicKey
+	}
+
+	return via
+}
+
+// lookupPeer returns the public key of the peer with the given name or public key.
+func lookupPeer(conf *latestconfig.Config, nameOrPublicKey string) (string, bool) {
+	for _, peerConf := range conf.Peers {
+		if (peerConf.Name != "" && peerConf.Name == nameOrPublicKey) || peerConf.PublicKey == nameOrPublicKey {
+			return peerConf.PublicKey, true
+		}
+	}
+
+	return "", false
+}
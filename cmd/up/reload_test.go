@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package up
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	"github.com/noisysockets/noisysockets/types"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPublicKeyA = "7fnQ1eXqnODkRu5DX0Ovb4BJOw+5GkUzSR9k0N+t9Vo="
+	testPublicKeyB = "GJKhbeW1HnqSUXq0NFq4hj47e2QV8a4Jf5ulrSLpNVE="
+	testPublicKeyC = "3qzvUEKtS1CwRUR+tk2+/ZSVjuNVH0mhf0/HqB2sXqo="
+)
+
+func TestApplyConfig(t *testing.T) {
+	peerA := latestconfig.PeerConfig{Name: "a", PublicKey: testPublicKeyA, IPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")}}
+	peerB := latestconfig.PeerConfig{Name: "b", PublicKey: testPublicKeyB, IPs: []netip.Addr{netip.MustParseAddr("100.64.0.3")}}
+	peerC := latestconfig.PeerConfig{Name: "c", PublicKey: testPublicKeyC, IPs: []netip.Addr{netip.MustParseAddr("100.64.0.4")}}
+
+	routeViaA := latestconfig.RouteConfig{Destination: netip.MustParsePrefix("10.0.0.0/8"), Via: "a"}
+	routeViaB := latestconfig.RouteConfig{Destination: netip.MustParsePrefix("10.0.0.0/8"), Via: "b"}
+
+	baseConf := func() *latestconfig.Config {
+		return &latestconfig.Config{
+			Name:       "node",
+			ListenPort: 51820,
+			IPs:        []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+			DNS: &latestconfig.DNSConfig{
+				Domain:  "my.nzzy.net.",
+				Servers: []types.MaybeAddrPort{types.MustParseMaybeAddrPort("100.64.0.2")},
+			},
+			Peers:  []latestconfig.PeerConfig{peerA, peerB},
+			Routes: []latestconfig.RouteConfig{routeViaA},
+		}
+	}
+
+	tests := []struct {
+		name string
+		// update modifies the new config.
+		update func(conf *latestconfig.Config)
+		// fail is the set of operations that will fail.
+		fail    []string
+		ops     []string
+		applied func(conf *latestconfig.Config)
+		wantErr bool
+	}{
+		{
+			name: "Unchanged",
+		},
+		{
+			name: "Peer Added",
+			update: func(conf *latestconfig.Config) {
+				conf.Peers = append(conf.Peers, peerC)
+			},
+			ops: []string{"add peer c"},
+		},
+		{
+			name: "Peer Removed",
+			update: func(conf *latestconfig.Config) {
+				conf.Peers = []latestconfig.PeerConfig{peerA}
+			},
+			ops: []string{"remove peer " + testPublicKeyB},
+		},
+		{
+			name: "Peer Endpoint Changed",
+			update: func(conf *latestconfig.Config) {
+				conf.Peers[0].Endpoint = "a.example.com:51820"
+			},
+			// The routes via the peer are removed along with it, so they are re-added.
+			ops: []string{"remove peer " + testPublicKeyA, "add peer a", "add route 10.0.0.0/8 via a"},
+		},
+		{
+			name: "Peer Key Changed",
+			update: func(conf *latestconfig.Config) {
+				conf.Peers[1] = latestconfig.PeerConfig{Name: "b", PublicKey: testPublicKeyC, IPs: peerB.IPs}
+			},
+			ops: []string{"remove peer " + testPublicKeyB, "add peer b"},
+		},
+		{
+			name: "Route Moved",
+			update: func(conf *latestconfig.Config) {
+				conf.Routes = []latestconfig.RouteConfig{routeViaB}
+			},
+			ops: []string{"remove route 10.0.0.0/8", "add route 10.0.0.0/8 via b"},
+		},
+		{
+			name: "Route Removed",
+			update: func(conf *latestconfig.Config) {
+				conf.Routes = nil
+			},
+			ops: []string{"remove route 10.0.0.0/8"},
+		},
+		{
+			name: "Peer Add Failed",
+			update: func(conf *latestconfig.Config) {
+				conf.Peers = append(conf.Peers, peerC)
+				conf.Routes = append(conf.Routes, latestconfig.RouteConfig{Destination: netip.MustParsePrefix("192.168.0.0/16"), Via: "c"})
+			},
+			fail: []string{"add peer c", "add route 192.168.0.0/16 via c"},
+			ops:  []string{"add peer c", "add route 192.168.0.0/16 via c"},
+			// Neither the peer nor its route are in effect, so they'll be retried.
+			applied: func(conf *latestconfig.Config) {},
+			wantErr: true,
+		},
+		{
+			name: "Route Remove Failed",
+			update: func(conf *latestconfig.Config) {
+				conf.Peers = append(conf.Peers, peerC)
+				conf.Routes = []latestconfig.RouteConfig{routeViaB}
+			},
+			fail: []string{"remove route 10.0.0.0/8"},
+			ops:  []string{"add peer c", "remove route 10.0.0.0/8"},
+			// The new peer is applied, but the old route is still in effect.
+			applied: func(conf *latestconfig.Config) {
+				conf.Peers = append(conf.Peers, peerC)
+			},
+			wantErr: true,
+		},
+		{
+			name: "Interface Changed",
+			update: func(conf *latestconfig.Config) {
+				conf.ListenPort = 51821
+				conf.IPs = []netip.Addr{netip.MustParseAddr("100.64.0.10")}
+			},
+			// Requires a restart.
+			applied: func(conf *latestconfig.Config) {},
+		},
+		{
+			name: "DNS Servers Changed",
+			update: func(conf *latestconfig.Config) {
+				conf.DNS.Servers = []types.MaybeAddrPort{types.MustParseMaybeAddrPort("100.64.0.3:53")}
+			},
+		},
+		{
+			name: "DNS Domain Changed",
+			update: func(conf *latestconfig.Config) {
+				conf.DNS.Domain = "other.nzzy.net."
+				conf.DNS.Servers = nil
+			},
+			// The domain requires a restart, but the servers are updated.
+			applied: func(conf *latestconfig.Config) {
+				conf.DNS.Servers = nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			net := &testNetwork{fail: tt.fail}
+
+			newConf := baseConf()
+			if tt.update != nil {
+				tt.update(newConf)
+			}
+
+			appliedConf, err := applyConfig(net, baseConf(), newConf)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.ElementsMatch(t, tt.ops, net.ops)
+
+			// By default everything should have been applied.
+			expectedConf := newConf
+			if tt.applied != nil {
+				expectedConf = baseConf()
+				tt.applied(expectedConf)
+			}
+
+			require.Equal(t, expectedConf.ListenPort, appliedConf.ListenPort)
+			require.Equal(t, expectedConf.IPs, appliedConf.IPs)
+			require.Equal(t, expectedConf.DNS, appliedConf.DNS)
+			require.ElementsMatch(t, expectedConf.Peers, appliedConf.Peers)
+			require.ElementsMatch(t, expectedConf.Routes, appliedConf.Routes)
+		})
+	}
+}
+
+// testNetwork records the changes applied to it.
+type testNetwork struct {
+	// fail is the set of operations that will fail.
+	fail []string
+	ops  []string
+}
+
+func (n *testNetwork) AddPeer(peerConf latestconfig.PeerConfig) error {
+	return n.record("add peer " + peerConf.Name)
+}
+
+func (n *testNetwork) RemovePeer(publicKey types.NoisePublicKey) {
+	_ = n.record("remove peer " + publicKey.String())
+}
+
+func (n *testNetwork) AddRoute(routeConf latestconfig.RouteConfig) error {
+	return n.record("add route " + routeConf.Destination.String() + " via " + routeConf.Via)
+}
+
+func (n *testNetwork) RemoveRoute(destination netip.Prefix) error {
+	return n.record("remove route " + destination.String())
+}
+
+func (n *testNetwork) record(op string) error {
+	n.ops = append(n.ops, op)
+
+	for _, failedOp := range n.fail {
+		if op == failedOp {
+			return errors.New("failed")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package up
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	"github.com/noisysockets/noisysockets/types"
+	"github.com/noisysockets/nsh/internal/control"
+	"github.com/noisysockets/nsh/internal/service"
+	"github.com/noisysockets/util/ptr"
+)
+
+// How long to wait for a peer to respond to a probe.
+const probeTimeout = 3 * time.Second
+
+// buildStatus returns a snapshot of the running network for the control API.
+func buildStatus(ctx context.Context, conf *latestconfig.Config, net *noisysockets.NoisySocketsNetwork,
+	services []service.Service, startedAt time.Time, probe bool) *control.Status {
+	status := &control.Status{
+		Name:       conf.Name,
+		ListenPort: net.ListenPort(),
+		IPs:        conf.IPs,
+		StartedAt:  startedAt,
+	}
+
+	var privateKey types.NoisePrivateKey
+	if err := privateKey.UnmarshalText([]byte(conf.PrivateKey)); err == nil {
+		status.PublicKey = privateKey.Public().String()
+	}
+
+	domain, err := net.Domain()
+	if err != nil {
+		slog.Warn("Failed to get network domain", slog.Any("error", err))
+	}
+	status.Domain = domain
+
+	for _, peerConf := range conf.Peers {
+		peerStatus := control.PeerStatus{
+			Name:               peerConf.Name,
+			PublicKey:          peerConf.PublicKey,
+			ConfiguredEndpoint: peerConf.Endpoint,
+			IPs:                peerConf.IPs,
+		}
+
+		for _, addr := range peerConf.IPs {
+			peerStatus.AllowedIPs = append(peerStatus.AllowedIPs, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+
+		for _, routeConf := range conf.Routes {
+			if (peerConf.Name != "" && routeConf.Via == peerConf.Name) || routeConf.Via == peerConf.PublicKey {
+				peerStatus.AllowedIPs = append(peerStatus.AllowedIPs, routeConf.Destination)
+			}
+		}
+
+		status.Peers = append(status.Peers, peerStatus)
+	}
+
+	if probe {
+		probePeers(ctx, net, status.Peers)
+	}
+
+	for _, routeConf := range conf.Routes {
+		status.Routes = append(status.Routes, control.RouteStatus{
+			Destination: routeConf.Destination,
+			Via:         routeConf.Via,
+		})
+	}
+
+	for _, s := range services {
+		status.Services = append(status.Services, s.Name())
+	}
+
+	return status
+}
+
+// probePeers checks the reachability of each peer by sending an ICMP echo
+// request to the peer's first address. A reply means the WireGuard handshake
+// with the peer has completed.
+func probePeers(ctx context.Context, net *noisysockets.NoisySocketsNetwork, peers []control.PeerStatus) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := range peers {
+		peer := &peers[i]
+		if len(peer.IPs) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			err := net.Ping(ctx, "ip", peer.IPs[0].String())
+			if err != nil {
+				slog.Debug("Peer did not respond to probe",
+					slog.String("peer", peer.PublicKey), slog.Any("error", err))
+			}
+
+			peer.Reachable = ptr.To(err == nil)
+			if err == nil {
+				peer.RTT = time.Since(start)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
@@ -17,14 +17,22 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/noisysockets/noisysockets"
 	configtypes "github.com/noisysockets/noisysockets/config/types"
+	"github.com/noisysockets/nsh/internal/control"
 	"github.com/noisysockets/nsh/internal/service"
 	"golang.org/x/sync/errgroup"
 )
 
-func Up(ctx context.Context, conf configtypes.Config, services []service.Service) error {
+func Up(ctx context.Context, configPath string, conf configtypes.Config,
+	controlSocketPath string, watchConfig bool, services []service.Service) error {
+	latestConf, err := toLatest(conf)
+	if err != nil {
+		return err
+	}
+
 	slog.Debug("Opening WireGuard network")
 
 	net, err := noisysockets.OpenNetwork(slog.Default(), conf)
@@ -33,6 +41,14 @@ func Up(ctx context.Context, conf configtypes.Config, services []service.Service
 	}
 	defer net.Close()
 
+	for _, s := range services {
+		if c, ok := s.(service.Configurable); ok {
+			c.SetConfig(latestConf)
+		}
+	}
+
+	startedAt := time.Now()
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	// Capture the signal to close the listener
@@ -49,6 +65,25 @@ func Up(ctx context.Context, conf configtypes.Config, services []service.Service
 		}
 	})
 
+	// Reload the config on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	r := newReloader(configPath, net, latestConf, services)
+
+	g.Go(func() error {
+		return r.Run(ctx, hup, watchConfig)
+	})
+
+	controlServer := control.NewServer(controlSocketPath, func(ctx context.Context, probe bool) *control.Status {
+		return buildStatus(ctx, r.Config(), net, services, startedAt, probe)
+	})
+
+	g.Go(func() error {
+		return controlServer.ListenAndServe(ctx)
+	})
+
 	for _, s := range services {
 		g.Go(func() error {
 			return s.Serve(ctx, net)
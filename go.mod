@@ -5,9 +5,12 @@ go 1.22.4
 require (
 	github.com/adrg/xdg v0.5.0
 	github.com/dpeckett/telemetry v0.1.2
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gofrs/flock v0.12.1
 	github.com/itchyny/gojq v0.12.16
 	github.com/miekg/dns v1.1.62
+	github.com/noisysockets/contextio v0.4.0
+	github.com/noisysockets/netstack v0.9.0
 	github.com/noisysockets/network v0.23.0
 	github.com/noisysockets/noisysockets v0.28.0
 	github.com/noisysockets/resolver v0.14.2
@@ -16,6 +19,8 @@ require (
 	github.com/urfave/cli/v2 v2.27.4
 	golang.org/x/net v0.29.0
 	golang.org/x/sync v0.8.0
+	golang.org/x/time v0.6.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -28,8 +33,6 @@ require (
 	github.com/itchyny/timefmt-go v0.1.6 // indirect
 	github.com/jinzhu/copier v0.4.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
-	github.com/noisysockets/contextio v0.4.0 // indirect
-	github.com/noisysockets/netstack v0.9.0 // indirect
 	github.com/noisysockets/netutil v0.9.0 // indirect
 	github.com/noisysockets/pinger v0.4.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
@@ -39,7 +42,6 @@ require (
 	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/mod v0.21.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
-	golang.org/x/time v0.6.0 // indirect
 	golang.org/x/tools v0.25.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 )
@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package config contains the nsh specific configuration (eg. service
+// settings), which is stored in the "nsh" section of the Noisy Sockets config
+// file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SectionKey is the key of the nsh section in the config file.
+const SectionKey = "nsh"
+
+// Config is the nsh specific configuration.
+type Config struct {
+	// DNS is the configuration for the DNS service.
+	DNS DNSConfig `yaml:"dns,omitempty"`
+	// Router is the configuration for the router service.
+	Router RouterConfig `yaml:"router,omitempty"`
+}
+
+// DNSConfig is the configuration for the DNS service.
+type DNSConfig struct {
+	// Records is an optional list of additional records for the network
+	// domain, in zone file format (eg. "_http._tcp.api IN SRV 10 5 8080 api").
+	Records []string `yaml:"records,omitempty"`
+	// ForwardZones is an optional list of conditional forwarding rules.
+	ForwardZones []ForwardZoneConfig `yaml:"forwardZones,omitempty"`
+}
+
+// ForwardZoneConfig forwards queries for a zone to specific DNS servers.
+type ForwardZoneConfig struct {
+	// Zone is the name of the zone (eg. "corp.internal").
+	Zone string `yaml:"zone"`
+	// Servers is the list of DNS servers to forward queries to, in the order
+	// they are tried (eg. "10.0.0.53", "tls://10.0.0.53").
+	Servers []string `yaml:"servers"`
+}
+
+// ForwardZoneSpecs returns the forwarding rules in the same form as the
+// --dns-forward-zone flag (eg. "corp.internal=10.0.0.53").
+func (c DNSConfig) ForwardZoneSpecs() []string {
+	var specs []string
+	for _, zone := range c.ForwardZones {
+		for _, server := range zone.Servers {
+			specs = append(specs, zone.Zone+"="+server)
+		}
+	}
+
+	return specs
+}
+
+// RouterConfig is the configuration for the router service.
+type RouterConfig struct {
+	// Allow is an optional list of destinations that packets can be forwarded
+	// to (eg. "10.20.0.0/16", "10.0.0.1:443", "fd00::/8:8000-8999").
+	Allow []string `yaml:"allow,omitempty"`
+	// Deny is an optional list of destinations that packets will never be
+	// forwarded to (eg. "169.254.169.254").
+	Deny []string `yaml:"deny,omitempty"`
+	// Policies is an optional list of destinations that specific peers can
+	// forward packets to.
+	Policies []RouterPolicyConfig `yaml:"policies,omitempty"`
+	// DefaultDeny denies forwarding packets from peers without a matching
+	// policy.
+	DefaultDeny bool `yaml:"defaultDeny,omitempty"`
+}
+
+// RouterPolicyConfig is the set of destinations a peer can forward packets to.
+type RouterPolicyConfig struct {
+	// Peer is a public key, or a peer name (which may contain wildcards).
+	Peer string `yaml:"peer"`
+	// Allow is the list of destinations the peer can forward packets to (or
+	// "*" for any destination).
+	Allow []string `yaml:"allow"`
+}
+
+// PolicySpecs returns the router policies in the same form as the
+// --router-policy flag (eg. "ci-runner=10.0.5.0/24:443").
+func (c RouterConfig) PolicySpecs() []string {
+	var specs []string
+	for _, policy := range c.Policies {
+		for _, dst := range policy.Allow {
+			specs = append(specs, policy.Peer+"="+dst)
+		}
+	}
+
+	return specs
+}
+
+// FromYAML reads the nsh section of a config file, if the section is missing
+// an empty config is returned.
+func FromYAML(data []byte) (*Config, error) {
+	var file struct {
+		Config Config `yaml:"nsh"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal nsh config: %w", err)
+	}
+
+	return &file.Config, nil
+}
+
+// Section returns the raw nsh section of a config file (or nil if it is
+// missing), so that it can be carried over when the file is rewritten.
+func Section(data []byte) (*yaml.Node, error) {
+	var file struct {
+		Section yaml.Node `yaml:"nsh"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal nsh config: %w", err)
+	}
+
+	if file.Section.IsZero() {
+		return nil, nil
+	}
+
+	return &file.Section, nil
+}
+
+// WithSection adds (or replaces) the nsh section of a config file.
+func WithSection(data []byte, section *yaml.Node) ([]byte, error) {
+	if section == nil {
+		return data, nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("expected config to be a mapping")
+	}
+	root := doc.Content[0]
+
+	var replaced bool
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == SectionKey {
+			root.Content[i+1] = section
+			replaced = true
+		}
+	}
+
+	if !replaced {
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: SectionKey}, section)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package config_test
+
+import (
+	"testing"
+
+	"github.com/noisysockets/nsh/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `apiVersion: noisysockets.github.com/v1alpha3
+kind: Config
+name: router
+nsh:
+    dns:
+        records:
+            - $TTL 60
+            - _http._tcp.api IN SRV 10 5 8080 api
+        forwardZones:
+            - zone: corp.internal
+              servers:
+                - 10.0.0.53
+                - 10.0.0.54
+            - zone: consul
+              servers:
+                - 127.0.0.1:8600
+    router:
+        deny:
+            - 169.254.169.254
+        policies:
+            - peer: ci-runner
+              allow:
+                - 10.0.5.0/24:443
+                - 10.0.6.0/24
+            - peer: laptop-*
+              allow:
+                - '*'
+        defaultDeny: true
+`
+
+func TestFromYAML(t *testing.T) {
+	conf, err := config.FromYAML([]byte(testConfig))
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"$TTL 60", "_http._tcp.api IN SRV 10 5 8080 api"}, conf.DNS.Records)
+	require.Equal(t, []string{
+		"corp.internal=10.0.0.53",
+		"corp.internal=10.0.0.54",
+		"consul=127.0.0.1:8600",
+	}, conf.DNS.ForwardZoneSpecs())
+
+	require.Empty(t, conf.Router.Allow)
+	require.Equal(t, []string{"169.254.169.254"}, conf.Router.Deny)
+	require.True(t, conf.Router.DefaultDeny)
+	require.Equal(t, []string{
+		"ci-runner=10.0.5.0/24:443",
+		"ci-runner=10.0.6.0/24",
+		"laptop-*=*",
+	}, conf.Router.PolicySpecs())
+
+	// The nsh section is optional.
+	conf, err = config.FromYAML([]byte("apiVersion: noisysockets.github.com/v1alpha3\nkind: Config\n"))
+	require.NoError(t, err)
+	require.Equal(t, &config.Config{}, conf)
+}
+
+func TestWithSection(t *testing.T) {
+	section, err := config.Section([]byte(testConfig))
+	require.NoError(t, err)
+	require.NotNil(t, section)
+
+	rewritten := []byte("apiVersion: noisysockets.github.com/v1alpha3\nkind: Config\nname: renamed\n")
+
+	data, err := config.WithSection(rewritten, section)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "name: renamed")
+
+	conf, err := config.FromYAML(data)
+	require.NoError(t, err)
+
+	expected, err := config.FromYAML([]byte(testConfig))
+	require.NoError(t, err)
+	require.Equal(t, expected, conf)
+
+	// Without a section the config is unchanged.
+	data, err = config.WithSection(rewritten, nil)
+	require.NoError(t, err)
+	require.Equal(t, rewritten, data)
+}
@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	stdnet "net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Client is a client for the control API of a running nsh instance.
+type Client struct {
+	socketPath string
+	httpClient *http.Client
+}
+
+// NewClient returns a new control API client for the given socket.
+func NewClient(socketPath string) *Client {
+	return &Client{
+		socketPath: socketPath,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (stdnet.Conn, error) {
+					var d stdnet.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Status returns the status of the running instance. If probe is true, the
+// reachability of each peer will be checked.
+func (c *Client) Status(ctx context.Context, probe bool) (*Status, error) {
+	query := url.Values{}
+	if probe {
+		query.Set("probe", "true")
+	}
+
+	var status Status
+	if err := c.get(ctx, "/v1/status", query, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, v any) error {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "nsh",
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("control socket %q does not exist, is `nsh up` running?", c.socketPath)
+		}
+
+		return fmt.Errorf("failed to query control API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected control API response %s: %s", resp.Status, body)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode control API response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package control implements the local control API of a running nsh instance.
+// The API is served as JSON over HTTP on a Unix domain socket, access is
+// restricted using the file permissions of the socket.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StatusFunc returns a snapshot of the current status. If probe is true, the
+// reachability of each peer should be checked.
+type StatusFunc func(ctx context.Context, probe bool) *Status
+
+// Server serves the control API on a Unix domain socket.
+type Server struct {
+	socketPath string
+	status     StatusFunc
+}
+
+// NewServer returns a new control API server.
+func NewServer(socketPath string, status StatusFunc) *Server {
+	return &Server{
+		socketPath: socketPath,
+		status:     status,
+	}
+}
+
+// ListenAndServe listens on the control socket and serves requests until the
+// context is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.socketPath), 0o700); err != nil {
+		return fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+
+	// Is there another instance already using this socket?
+	if conn, err := stdnet.Dial("unix", s.socketPath); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("control socket %q is in use by another process", s.socketPath)
+	}
+
+	// Remove any stale socket left behind by a previous instance.
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	lis, err := listenPrivate(s.socketPath)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+
+	srv := &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Failed to shutdown control server", slog.Any("error", err))
+		}
+	}()
+
+	slog.Info("Listening for control requests", slog.String("path", s.socketPath))
+
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve control API: %w", err)
+	}
+
+	return nil
+}
+
+// listenPrivate listens on a Unix domain socket that only the owner is allowed
+// to connect to. The socket is created in a private directory and moved into
+// place once its permissions are set, so that there is never a window where
+// other users can connect to it.
+func listenPrivate(socketPath string) (stdnet.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(socketPath), ".nsh-control-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create private control socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	privatePath := filepath.Join(dir, filepath.Base(socketPath))
+
+	lis, err := stdnet.Listen("unix", privatePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+
+	if err := os.Chmod(privatePath, 0o600); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+
+	if err := os.Rename(privatePath, socketPath); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("failed to move control socket into place: %w", err)
+	}
+
+	// The listener would otherwise try to remove the socket at its original path.
+	lis.(*stdnet.UnixListener).SetUnlinkOnClose(false)
+
+	return &unlinkOnCloseListener{Listener: lis, path: socketPath}, nil
+}
+
+// unlinkOnCloseListener removes the socket file when the listener is closed.
+type unlinkOnCloseListener struct {
+	stdnet.Listener
+	path      string
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (l *unlinkOnCloseListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = l.Listener.Close()
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) && l.closeErr == nil {
+			l.closeErr = err
+		}
+	})
+
+	return l.closeErr
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.status(r.Context(), probeRequested(r)))
+	})
+
+	mux.HandleFunc("GET /v1/peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.status(r.Context(), probeRequested(r)).Peers)
+	})
+
+	mux.HandleFunc("GET /v1/routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.status(r.Context(), false).Routes)
+	})
+
+	mux.HandleFunc("GET /v1/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.status(r.Context(), false).Services)
+	})
+
+	return mux
+}
+
+func probeRequested(r *http.Request) bool {
+	probe, _ := strconv.ParseBool(r.URL.Query().Get("probe"))
+	return probe
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write control response", slog.Any("error", err))
+	}
+}
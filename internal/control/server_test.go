@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package control
+
+import (
+	stdnet "net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix file permissions are not supported on Windows")
+	}
+
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "nsh.sock")
+
+	lis, err := listenPrivate(socketPath)
+	require.NoError(t, err)
+
+	fi, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// The private directory is cleaned up.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := stdnet.Dial("unix", socketPath)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	require.NoError(t, lis.Close())
+	require.NoError(t, lis.Close())
+
+	_, err = os.Stat(socketPath)
+	require.True(t, os.IsNotExist(err))
+}
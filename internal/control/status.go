@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package control
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Status is a snapshot of the state of a running nsh instance.
+type Status struct {
+	// Name is the hostname of this peer.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// PublicKey is the public key of this peer.
+	PublicKey string `json:"publicKey" yaml:"publicKey"`
+	// ListenPort is the port WireGuard is listening on.
+	ListenPort uint16 `json:"listenPort" yaml:"listenPort"`
+	// Domain is the network domain.
+	Domain string `json:"domain" yaml:"domain"`
+	// IPs is the list of IP addresses assigned to this peer.
+	IPs []netip.Addr `json:"ips,omitempty" yaml:"ips,omitempty"`
+	// StartedAt is when the network was brought up.
+	StartedAt time.Time `json:"startedAt" yaml:"startedAt"`
+	// Peers is the list of configured peers.
+	Peers []PeerStatus `json:"peers,omitempty" yaml:"peers,omitempty"`
+	// Routes is the active routing table.
+	Routes []RouteStatus `json:"routes,omitempty" yaml:"routes,omitempty"`
+	// Services is the list of running services.
+	Services []string `json:"services,omitempty" yaml:"services,omitempty"`
+}
+
+// PeerStatus is the state of a single peer.
+type PeerStatus struct {
+	// Name is the optional hostname of the peer.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// PublicKey is the public key of the peer.
+	PublicKey string `json:"publicKey" yaml:"publicKey"`
+	// ConfiguredEndpoint is the endpoint of the peer from the configuration
+	// (if any), the peer may have since roamed to a different endpoint.
+	ConfiguredEndpoint string `json:"configuredEndpoint,omitempty" yaml:"configuredEndpoint,omitempty"`
+	// IPs is the list of IP addresses assigned to the peer.
+	IPs []netip.Addr `json:"ips,omitempty" yaml:"ips,omitempty"`
+	// AllowedIPs is the list of prefixes that will be routed to the peer,
+	// this includes the peer's own addresses and any routes via the peer.
+	AllowedIPs []netip.Prefix `json:"allowedIPs,omitempty" yaml:"allowedIPs,omitempty"`
+	// Reachable is whether the peer responded to a probe, it is only set if
+	// the status was requested with probing enabled.
+	Reachable *bool `json:"reachable,omitempty" yaml:"reachable,omitempty"`
+	// RTT is the round trip time of the probe (if the peer was reachable).
+	RTT time.Duration `json:"rtt,omitempty" yaml:"rtt,omitempty"`
+}
+
+// RouteStatus is the state of a single route.
+type RouteStatus struct {
+	// Destination is the CIDR block for which this route is used.
+	Destination netip.Prefix `json:"destination" yaml:"destination"`
+	// Via is the name (or public key) of the gateway peer.
+	Via string `json:"via" yaml:"via"`
+}
@@ -0,0 +1,397 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The TTL of synthesized responses for blocked names.
+const blockedTTL = 60
+
+type blocklistAction int
+
+const (
+	// Block the name, using the sinkhole addresses (if any), or NXDOMAIN.
+	blocklistActionBlock blocklistAction = iota
+	// Respond with NXDOMAIN.
+	blocklistActionNXDomain
+	// Respond with no records (NODATA).
+	blocklistActionNoData
+	// Don't block the name, overriding any later lists.
+	blocklistActionPassthru
+	// Respond with the records defined in the policy.
+	blocklistActionLocalData
+)
+
+type blocklistRule struct {
+	action  blocklistAction
+	records []dns.RR
+}
+
+type blocklistRules struct {
+	exact    map[string]*blocklistRule
+	wildcard map[string]*blocklistRule
+}
+
+func (r *blocklistRules) Len() int {
+	return len(r.exact) + len(r.wildcard)
+}
+
+// Match returns the rule for a name. Exact matches take precedence over
+// wildcard matches, and more specific wildcards over less specific ones.
+func (r *blocklistRules) Match(name string) (*blocklistRule, bool) {
+	if rule, ok := r.exact[name]; ok {
+		return rule, true
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if rule, ok := r.wildcard[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
+
+// blocklist is a list of blocked names loaded from a hosts-format file, or an
+// RPZ (Response Policy Zone) file.
+type blocklist struct {
+	path    string
+	modTime time.Time
+	rules   atomic.Pointer[blocklistRules]
+	hits    atomic.Uint64
+}
+
+// blocklists is an ordered set of blocklists, the first list that matches a
+// name determines how the name is handled.
+type blocklists struct {
+	lists    []*blocklist
+	sinkhole []netip.Addr
+}
+
+// loadBlocklists loads blocklists from the given files. Files with a .rpz or
+// .zone extension are parsed as response policy zones, all other files as
+// hosts files (or plain lists of names).
+func loadBlocklists(paths []string, sinkhole []netip.Addr) (*blocklists, error) {
+	b := &blocklists{
+		sinkhole: sinkhole,
+	}
+
+	for _, path := range paths {
+		list := &blocklist{path: path}
+		if _, err := list.reload(); err != nil {
+			return nil, err
+		}
+
+		slog.Info("Loaded DNS blocklist",
+			slog.String("path", path), slog.Int("rules", list.rules.Load().Len()))
+
+		b.lists = append(b.lists, list)
+	}
+
+	return b, nil
+}
+
+// Run periodically reloads any blocklists that have changed.
+func (b *blocklists) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, list := range b.lists {
+				reloaded, err := list.reload()
+				if err != nil {
+					slog.Warn("Failed to reload DNS blocklist",
+						slog.String("path", list.path), slog.Any("error", err))
+					continue
+				}
+
+				if reloaded {
+					slog.Info("Reloaded DNS blocklist",
+						slog.String("path", list.path), slog.Int("rules", list.rules.Load().Len()))
+				}
+			}
+		}
+	}
+}
+
+// LogStats logs the number of hits for each blocklist.
+func (b *blocklists) LogStats() {
+	for _, list := range b.lists {
+		slog.Info("DNS blocklist statistics",
+			slog.String("path", list.path),
+			slog.Uint64("hits", list.hits.Load()),
+			slog.Int("rules", list.rules.Load().Len()))
+	}
+}
+
+// Apply checks the name in the question against the blocklists. If the name
+// is blocked, it returns the rcode and answer to use in the response, along
+// with the path of the matching blocklist.
+func (b *blocklists) Apply(q dns.Question) (rcode int, answer []dns.RR, path string, blocked bool) {
+	name := dns.CanonicalName(q.Name)
+
+	for _, list := range b.lists {
+		rule, ok := list.rules.Load().Match(name)
+		if !ok {
+			continue
+		}
+
+		if rule.action == blocklistActionPassthru {
+			return dns.RcodeSuccess, nil, "", false
+		}
+
+		list.hits.Add(1)
+
+		switch rule.action {
+		case blocklistActionBlock:
+			if len(b.sinkhole) == 0 {
+				return dns.RcodeNameError, nil, list.path, true
+			}
+
+			return dns.RcodeSuccess, b.sinkholeRecords(q), list.path, true
+		case blocklistActionNXDomain:
+			return dns.RcodeNameError, nil, list.path, true
+		case blocklistActionNoData:
+			return dns.RcodeSuccess, nil, list.path, true
+		case blocklistActionLocalData:
+			for _, rr := range rule.records {
+				if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+					rr = dns.Copy(rr)
+					rr.Header().Name = q.Name
+					answer = append(answer, rr)
+				}
+			}
+
+			return dns.RcodeSuccess, answer, list.path, true
+		}
+	}
+
+	return dns.RcodeSuccess, nil, "", false
+}
+
+func (b *blocklists) sinkholeRecords(q dns.Question) []dns.RR {
+	var rrs []dns.RR
+	for _, addr := range b.sinkhole {
+		hdr := dns.RR_Header{
+			Name:  q.Name,
+			Class: dns.ClassINET,
+			Ttl:   blockedTTL,
+		}
+
+		switch {
+		case addr.Is4() && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
+			hdr.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: stdnet.IP(addr.AsSlice())})
+		case addr.Is6() && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: stdnet.IP(addr.AsSlice())})
+		}
+	}
+
+	return rrs
+}
+
+// reload reloads the blocklist if the file has changed since it was last
+// loaded, it returns true if the blocklist was reloaded.
+func (l *blocklist) reload() (bool, error) {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat blocklist: %w", err)
+	}
+
+	if l.rules.Load() != nil && fi.ModTime().Equal(l.modTime) {
+		return false, nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open blocklist: %w", err)
+	}
+	defer f.Close()
+
+	var rules *blocklistRules
+	switch strings.ToLower(filepath.Ext(l.path)) {
+	case ".rpz", ".zone":
+		rules, err = parseRPZ(f, l.path)
+	default:
+		rules, err = parseHosts(f)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to parse blocklist %s: %w", l.path, err)
+	}
+
+	l.rules.Store(rules)
+	l.modTime = fi.ModTime()
+
+	return true, nil
+}
+
+// Names that are commonly found in hosts files, but shouldn't be blocked.
+var ignoredHostsNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// parseHosts parses a hosts format file (eg. "0.0.0.0 ads.example.com"), or a
+// plain list of names (one per line).
+func parseHosts(r io.Reader) (*blocklistRules, error) {
+	rules := &blocklistRules{
+		exact: make(map[string]*blocklistRule),
+	}
+
+	block := &blocklistRule{action: blocklistActionBlock}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Skip the address in hosts format files.
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			fields = fields[1:]
+		}
+
+		for _, name := range fields {
+			name = dns.CanonicalName(name)
+			if _, ok := dns.IsDomainName(name); !ok || ignoredHostsNames[name] {
+				continue
+			}
+
+			rules.exact[name] = block
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// parseRPZ parses a response policy zone file. Only QNAME triggers are
+// supported, with the NXDOMAIN ("CNAME ."), NODATA ("CNAME *."), PASSTHRU
+// ("CNAME rpz-passthru.") and local data actions.
+func parseRPZ(r io.Reader, path string) (*blocklistRules, error) {
+	rules := &blocklistRules{
+		exact:    make(map[string]*blocklistRule),
+		wildcard: make(map[string]*blocklistRule),
+	}
+
+	var origin string
+
+	// Policy zone files are usually loaded with an origin defined elsewhere, so
+	// relative names need a default origin. The SOA record defines the actual
+	// origin of the zone.
+	zp := dns.NewZoneParser(r, "rpz.", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			// The SOA record defines the origin of the policy zone.
+			origin = name
+			continue
+		case dns.TypeNS:
+			continue
+		}
+
+		if origin == "" {
+			return nil, fmt.Errorf("policy zone is missing a SOA record")
+		}
+
+		if !dns.IsSubDomain(origin, name) || name == origin {
+			continue
+		}
+
+		trigger := dns.Fqdn(strings.TrimSuffix(strings.TrimSuffix(name, origin), "."))
+
+		target := rules.exact
+		if strings.HasPrefix(trigger, "*.") {
+			trigger = strings.TrimPrefix(trigger, "*.")
+			target = rules.wildcard
+		}
+
+		var action blocklistAction
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch dns.CanonicalName(cname.Target) {
+			case ".":
+				action = blocklistActionNXDomain
+			case "*.":
+				action = blocklistActionNoData
+			case "rpz-passthru.":
+				action = blocklistActionPassthru
+			default:
+				if strings.HasPrefix(cname.Target, "rpz-") {
+					slog.Warn("Ignoring unsupported policy zone action",
+						slog.String("name", name), slog.String("action", cname.Target))
+					continue
+				}
+
+				action = blocklistActionLocalData
+			}
+		} else {
+			action = blocklistActionLocalData
+		}
+
+		if action == blocklistActionLocalData {
+			rule, ok := target[trigger]
+			if !ok || rule.action != blocklistActionLocalData {
+				rule = &blocklistRule{action: blocklistActionLocalData}
+				target[trigger] = rule
+			}
+
+			rr.Header().Ttl = min(rr.Header().Ttl, blockedTTL)
+			rule.records = append(rule.records, rr)
+			continue
+		}
+
+		target[trigger] = &blocklistRule{action: action}
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
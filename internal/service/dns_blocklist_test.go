@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const testRPZ = `$TTL 300
+@                         IN SOA  localhost. admin.localhost. 1 3600 600 86400 300
+                          IN NS   localhost.
+
+nxdomain.example.com      IN CNAME .
+nodata.example.com        IN CNAME *.
+passthru.example.com      IN CNAME rpz-passthru.
+drop.example.com          IN CNAME rpz-drop.
+local.example.com         IN A     192.0.2.1
+local.example.com         IN AAAA  2001:db8::1
+local.example.com         IN TXT   "blocked"
+alias.example.com         IN CNAME walled-garden.example.net.
+
+*.ads.example.com         IN CNAME .
+good.ads.example.com      IN CNAME rpz-passthru.
+*.video.ads.example.com   IN CNAME *.
+*.wild.example.com        IN A     192.0.2.2
+`
+
+func TestBlocklistRPZ(t *testing.T) {
+	dir := t.TempDir()
+
+	rpzPath := filepath.Join(dir, "policy.rpz")
+	require.NoError(t, os.WriteFile(rpzPath, []byte(testRPZ), 0o644))
+
+	// A later hosts list that would block everything the policy zone lets
+	// through.
+	hostsPath := filepath.Join(dir, "hosts.txt")
+	require.NoError(t, os.WriteFile(hostsPath, []byte(strings.Join([]string{
+		"0.0.0.0 passthru.example.com",
+		"0.0.0.0 good.ads.example.com",
+		"0.0.0.0 hosts.example.com",
+	}, "\n")), 0o644))
+
+	lists, err := loadBlocklists([]string{rpzPath, hostsPath}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		qType   uint16
+		blocked bool
+		rcode   int
+		answer  []string
+		path    string
+	}{
+		{name: "nxdomain.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeNameError, path: rpzPath},
+		{name: "nodata.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeSuccess, path: rpzPath},
+		// Passthru overrides any later lists.
+		{name: "passthru.example.com.", qType: dns.TypeA},
+		// Unsupported actions are ignored.
+		{name: "drop.example.com.", qType: dns.TypeA},
+		{name: "local.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeSuccess, path: rpzPath,
+			answer: []string{"local.example.com.\t60\tIN\tA\t192.0.2.1"}},
+		{name: "LOCAL.example.com.", qType: dns.TypeTXT, blocked: true, rcode: dns.RcodeSuccess, path: rpzPath,
+			answer: []string{"LOCAL.example.com.\t60\tIN\tTXT\t\"blocked\""}},
+		// Local data without records of the type is NODATA.
+		{name: "local.example.com.", qType: dns.TypeMX, blocked: true, rcode: dns.RcodeSuccess, path: rpzPath},
+		// CNAMEs to other names are local data.
+		{name: "alias.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeSuccess, path: rpzPath,
+			answer: []string{"alias.example.com.\t60\tIN\tCNAME\twalled-garden.example.net."}},
+		// Wildcards match subdomains, but not the name itself.
+		{name: "tracker.ads.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeNameError, path: rpzPath},
+		{name: "a.b.ads.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeNameError, path: rpzPath},
+		{name: "ads.example.com.", qType: dns.TypeA},
+		// Exact matches take precedence over wildcards.
+		{name: "good.ads.example.com.", qType: dns.TypeA},
+		// More specific wildcards take precedence over less specific ones.
+		{name: "cdn.video.ads.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeSuccess, path: rpzPath},
+		// Wildcard local data is synthesized for the queried name.
+		{name: "host.wild.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeSuccess, path: rpzPath,
+			answer: []string{"host.wild.example.com.\t60\tIN\tA\t192.0.2.2"}},
+		// Names not in the policy zone fall through to later lists.
+		{name: "hosts.example.com.", qType: dns.TypeA, blocked: true, rcode: dns.RcodeNameError, path: hostsPath},
+		{name: "example.com.", qType: dns.TypeA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" "+dns.TypeToString[tt.qType], func(t *testing.T) {
+			rcode, answer, path, blocked := lists.Apply(dns.Question{Name: tt.name, Qtype: tt.qType, Qclass: dns.ClassINET})
+			require.Equal(t, tt.blocked, blocked)
+			require.Equal(t, tt.path, path)
+
+			if !tt.blocked {
+				return
+			}
+
+			require.Equal(t, tt.rcode, rcode)
+
+			var got []string
+			for _, rr := range answer {
+				got = append(got, rr.String())
+			}
+			require.Equal(t, tt.answer, got)
+		})
+	}
+}
+
+func TestBlocklistRPZMissingSOA(t *testing.T) {
+	_, err := parseRPZ(strings.NewReader("bad.example.com 300 IN CNAME .\n"), "policy.rpz")
+	require.ErrorContains(t, err, "missing a SOA record")
+}
+
+func TestBlocklistReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.rpz")
+	require.NoError(t, os.WriteFile(path, []byte(testRPZ), 0o644))
+
+	lists, err := loadBlocklists([]string{path}, nil)
+	require.NoError(t, err)
+
+	list := lists.lists[0]
+
+	q := dns.Question{Name: "new.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	_, _, _, blocked := lists.Apply(q)
+	require.False(t, blocked)
+
+	// Nothing is reloaded if the file hasn't changed.
+	reloaded, err := list.reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	require.NoError(t, os.WriteFile(path, []byte(testRPZ+"new.example.com IN CNAME .\n"), 0o644))
+
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	reloaded, err = list.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+
+	rcode, _, _, blocked := lists.Apply(q)
+	require.True(t, blocked)
+	require.Equal(t, dns.RcodeNameError, rcode)
+
+	// A broken file keeps the previous rules.
+	require.NoError(t, os.WriteFile(path, []byte("new.example.com 300 IN CNAME .\n"), 0o644))
+
+	modTime = modTime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	_, err = list.reload()
+	require.Error(t, err)
+
+	_, _, _, blocked = lists.Apply(q)
+	require.True(t, blocked)
+}
@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsCache is a LRU cache of DNS responses, supporting both positive and
+// negative (RFC 2308) caching.
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	entries map[dnsCacheKey]*list.Element
+	lru     *list.List
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+type dnsCacheKey struct {
+	name             string
+	qType            uint16
+	qClass           uint16
+	checkingDisabled bool
+}
+
+type dnsCacheEntry struct {
+	key       dnsCacheKey
+	reply     *dns.Msg
+	origin    queryOrigin
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+func newDNSCache(size int, minTTL, maxTTL time.Duration) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		minTTL:  minTTL,
+		maxTTL:  maxTTL,
+		entries: make(map[dnsCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns a copy of the cached reply for the given question (if any), with
+// TTLs adjusted to account for the time spent in the cache.
+// Get returns the cached reply for the given question (if any), and how the
+// question was originally answered.
+func (c *dnsCache) Get(q dns.Question, checkingDisabled bool) (*dns.Msg, queryOrigin) {
+	key := newDNSCacheKey(q, checkingDisabled)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, queryOrigin{}
+	}
+
+	entry := elem.Value.(*dnsCacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+
+		c.misses.Add(1)
+		return nil, queryOrigin{}
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits.Add(1)
+
+	reply := entry.reply.Copy()
+
+	elapsed := uint32(now.Sub(entry.storedAt) / time.Second)
+	remaining := uint32(entry.expiresAt.Sub(now) / time.Second)
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+
+			// Never hand out a TTL longer than the remaining lifetime of the entry.
+			hdr.Ttl = min(hdr.Ttl, remaining)
+		}
+	}
+
+	return reply, entry.origin
+}
+
+// Put stores the reply for the given question in the cache (if it is cacheable),
+// along with how the question was answered.
+func (c *dnsCache) Put(q dns.Question, checkingDisabled bool, reply *dns.Msg, origin queryOrigin) {
+	ttl, ok := c.ttl(reply)
+	if !ok {
+		return
+	}
+
+	reply = reply.Copy()
+
+	// Clamp the TTLs of the cached records so that clients see consistent TTLs.
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = uint32(c.clamp(time.Duration(hdr.Ttl)*time.Second) / time.Second)
+			}
+		}
+	}
+
+	key := newDNSCacheKey(q, checkingDisabled)
+	now := time.Now()
+
+	entry := &dnsCacheEntry{
+		key:       key,
+		reply:     reply,
+		origin:    origin,
+		storedAt:  now,
+		expiresAt: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *dnsCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Stats returns the number of cache hits and misses.
+func (c *dnsCache) Stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// ttl returns how long the reply can be cached for.
+func (c *dnsCache) ttl(reply *dns.Msg) (time.Duration, bool) {
+	if reply.Truncated {
+		return 0, false
+	}
+
+	var ttl uint32
+	var found bool
+
+	switch {
+	case reply.Rcode == dns.RcodeSuccess && len(reply.Answer) > 0:
+		for _, rr := range reply.Answer {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	case reply.Rcode == dns.RcodeSuccess || reply.Rcode == dns.RcodeNameError:
+		// Negative responses are cached using the SOA record from the authority
+		// section (RFC 2308 Section 5).
+		for _, rr := range reply.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = min(soa.Hdr.Ttl, soa.Minttl)
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	d := c.clamp(time.Duration(ttl) * time.Second)
+
+	return d, d > 0
+}
+
+// clamp limits a TTL to the configured minimum and maximum TTLs.
+func (c *dnsCache) clamp(ttl time.Duration) time.Duration {
+	ttl = max(ttl, c.minTTL)
+	if c.maxTTL > 0 {
+		ttl = min(ttl, c.maxTTL)
+	}
+
+	return ttl
+}
+
+func newDNSCacheKey(q dns.Question, checkingDisabled bool) dnsCacheKey {
+	return dnsCacheKey{
+		name:             dns.CanonicalName(q.Name),
+		qType:            q.Qtype,
+		qClass:           q.Qclass,
+		checkingDisabled: checkingDisabled,
+	}
+}
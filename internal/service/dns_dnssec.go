@@ -0,0 +1,848 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// The maximum time to trust the keys of a zone before fetching them again.
+	dnssecMaxKeyTTL = time.Hour
+	// The maximum number of names to cache the enclosing zone of.
+	dnssecMaxZones = 10000
+)
+
+// loadTrustAnchors loads DNSSEC trust anchors (DS or DNSKEY records) from a
+// zone file, eg. the output of `dig . DNSKEY` for the root zone.
+func loadTrustAnchors(path string) (map[string][]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trust anchor file: %w", err)
+	}
+	defer f.Close()
+
+	anchors := make(map[string][]dns.RR)
+
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr := rr.(type) {
+		case *dns.DS:
+		case *dns.DNSKEY:
+			// Only key signing keys are useful as trust anchors.
+			if rr.Flags&dns.SEP == 0 {
+				continue
+			}
+		default:
+			continue
+		}
+
+		zone := dns.CanonicalName(rr.Header().Name)
+		anchors[zone] = append(anchors[zone], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse trust anchor file: %w", err)
+	}
+
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no DS or DNSKEY records found in trust anchor file %q", path)
+	}
+
+	return anchors, nil
+}
+
+// dnssecZone is the result of following the chain of trust to a zone.
+type dnssecZone struct {
+	name string
+	// keys are the validated keys of the zone, or nil if the zone is insecure.
+	keys      []*dns.DNSKEY
+	expiresAt time.Time
+}
+
+// dnssecValidator validates DNSSEC (RFC 4035) signed responses, by following
+// the chain of trust from a trust anchor down to the zone that signed the
+// response.
+type dnssecValidator struct {
+	upstream upstream
+	anchors  map[string][]dns.RR
+	mu       sync.Mutex
+	// zones is a LRU cache of the closest enclosing zone of names.
+	zones    map[string]*list.Element
+	lru      *list.List
+	maxZones int
+}
+
+type dnssecZoneEntry struct {
+	name string
+	zone *dnssecZone
+}
+
+func newDNSSECValidator(upstream upstream, anchors map[string][]dns.RR) *dnssecValidator {
+	return &dnssecValidator{
+		upstream: upstream,
+		anchors:  anchors,
+		zones:    make(map[string]*list.Element),
+		lru:      list.New(),
+		maxZones: dnssecMaxZones,
+	}
+}
+
+// Validate checks the signatures of a response to a question. It returns true
+// if the response is secure, false if the response is insecure (ie. the zone
+// is unsigned), or an error if the response is bogus.
+func (v *dnssecValidator) Validate(ctx context.Context, q dns.Question, reply *dns.Msg) (bool, error) {
+	if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+
+	secure := true
+
+	// The name we need to prove doesn't exist (for negative responses), which
+	// is the target of any CNAME chain.
+	name := dns.CanonicalName(q.Name)
+	var answered bool
+
+	// Answers synthesized from wildcards, and the number of labels in the
+	// wildcard (not including the "*" label).
+	wildcards := make(map[string]uint8)
+
+	for _, rrset := range splitRRsets(reply.Answer) {
+		ok, err := v.verifyRRset(ctx, reply.Answer, rrset)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+
+		hdr := rrset[0].Header()
+
+		if labels, expanded := wildcardExpansion(reply.Answer, rrset); ok && expanded {
+			wildcards[dns.CanonicalName(hdr.Name)] = labels
+		}
+		if !strings.EqualFold(hdr.Name, name) {
+			continue
+		}
+
+		if cname, ok := rrset[0].(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME {
+			name = dns.CanonicalName(cname.Target)
+		} else if hdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			answered = true
+		}
+	}
+
+	// Wildcard expansions must come with proof that the name itself doesn't
+	// exist (RFC 4035 Section 5.3.4).
+	if len(wildcards) > 0 {
+		for _, rrset := range splitRRsets(reply.Ns) {
+			if rrtype := rrset[0].Header().Rrtype; rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3 {
+				continue
+			}
+
+			ok, err := v.verifyRRset(ctx, reply.Ns, rrset)
+			if err != nil {
+				return false, err
+			}
+			secure = secure && ok
+		}
+
+		if secure {
+			for owner, labels := range wildcards {
+				if !provesWildcardExpansion(reply.Ns, owner, labels) {
+					return false, fmt.Errorf("missing proof of non-existence for wildcard expansion of %s", owner)
+				}
+			}
+		}
+	}
+
+	if reply.Rcode == dns.RcodeSuccess && answered {
+		return secure, nil
+	}
+
+	// A negative response, the authority section must prove that the name (or
+	// type) doesn't exist.
+	for _, rrset := range splitRRsets(reply.Ns) {
+		ok, err := v.verifyRRset(ctx, reply.Ns, rrset)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+	}
+
+	if !secure {
+		return false, nil
+	}
+
+	zone, err := v.zone(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	if zone.keys == nil {
+		return false, nil
+	}
+
+	if !provesDenial(reply.Ns, name, q.Qtype, reply.Rcode == dns.RcodeNameError) {
+		return false, fmt.Errorf("missing proof of non-existence for %s", name)
+	}
+
+	return true, nil
+}
+
+// verifyRRset checks the signature of an RRset in a section of a response.
+func (v *dnssecValidator) verifyRRset(ctx context.Context, section, rrset []dns.RR) (bool, error) {
+	hdr := rrset[0].Header()
+
+	sigs := rrsigs(section, hdr.Name, hdr.Rrtype)
+	if len(sigs) == 0 {
+		// Unsigned records are only acceptable in insecure zones.
+		zone, err := v.zone(ctx, hdr.Name)
+		if err != nil {
+			return false, err
+		}
+
+		if zone.keys != nil {
+			return false, fmt.Errorf("missing signature for %s %s",
+				hdr.Name, dns.TypeToString[hdr.Rrtype])
+		}
+
+		return false, nil
+	}
+
+	// The signer must be the zone that contains the records, DS records are
+	// the exception as they belong to the parent zone.
+	name := hdr.Name
+	if hdr.Rrtype == dns.TypeDS {
+		if off, end := dns.NextLabel(name, 0); !end {
+			name = name[off:]
+		}
+	}
+
+	zone, err := v.zone(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	if zone.keys == nil {
+		return false, nil
+	}
+
+	if err := verifySignatures(sigs, rrset, zone); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// zone returns the closest enclosing zone of a name, by following the chain of
+// trust down from the closest trust anchor.
+func (v *dnssecValidator) zone(ctx context.Context, name string) (*dnssecZone, error) {
+	name = dns.CanonicalName(name)
+
+	var anchor string
+	for zone := range v.anchors {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(anchor) {
+			anchor = zone
+		}
+	}
+
+	// Names without a trust anchor are insecure.
+	if anchor == "" {
+		return &dnssecZone{name: ".", expiresAt: time.Now().Add(dnssecMaxKeyTTL)}, nil
+	}
+
+	zone, ok := v.cached(anchor)
+	if !ok {
+		keys, ttl, err := v.keys(ctx, anchor, v.anchors[anchor])
+		if err != nil {
+			return nil, err
+		}
+
+		zone = &dnssecZone{name: anchor, keys: keys, expiresAt: time.Now().Add(ttl)}
+		v.store(anchor, zone)
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(anchor) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		if cachedZone, ok := v.cached(child); ok {
+			zone = cachedZone
+			continue
+		}
+
+		// Everything below an insecure zone is also insecure.
+		if zone.keys != nil {
+			var err error
+			zone, err = v.delegation(ctx, zone, child)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		v.store(child, zone)
+	}
+
+	return zone, nil
+}
+
+// delegation checks whether a name is the apex of a signed zone, using the DS
+// records in its parent zone.
+func (v *dnssecValidator) delegation(ctx context.Context, parent *dnssecZone, child string) (*dnssecZone, error) {
+	reply, err := v.query(ctx, child, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	var dsRecords []dns.RR
+	for _, rrset := range splitRRsets(reply.Answer) {
+		hdr := rrset[0].Header()
+		if !strings.EqualFold(hdr.Name, child) {
+			continue
+		}
+
+		if err := verifySignatures(rrsigs(reply.Answer, hdr.Name, hdr.Rrtype), rrset, parent); err != nil {
+			return nil, err
+		}
+
+		switch hdr.Rrtype {
+		case dns.TypeDS:
+			dsRecords = rrset
+		case dns.TypeCNAME:
+			// An alias can't be a zone cut.
+			return parent, nil
+		}
+	}
+
+	if len(dsRecords) == 0 {
+		// The negative response must be signed by the parent zone.
+		for _, rrset := range splitRRsets(reply.Ns) {
+			hdr := rrset[0].Header()
+			if err := verifySignatures(rrsigs(reply.Ns, hdr.Name, hdr.Rrtype), rrset, parent); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(dsRecords) > 0 {
+		keys, ttl, err := v.keys(ctx, child, dsRecords)
+		if err != nil {
+			return nil, err
+		}
+
+		return &dnssecZone{
+			name:      child,
+			keys:      keys,
+			expiresAt: minTime(parent.expiresAt, time.Now().Add(ttl)),
+		}, nil
+	}
+
+	if insecureDelegation(reply.Ns, child) {
+		return &dnssecZone{name: child, expiresAt: parent.expiresAt}, nil
+	}
+
+	// Not a zone cut, so the name is part of the parent zone.
+	return parent, nil
+}
+
+// keys fetches the DNSKEY records of a zone, and validates them using the
+// trusted DS or DNSKEY records for the zone.
+func (v *dnssecValidator) keys(ctx context.Context, zone string, trusted []dns.RR) ([]*dns.DNSKEY, time.Duration, error) {
+	reply, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ttl := dnssecMaxKeyTTL
+
+	var keyRRset []dns.RR
+	var keys, entryKeys []*dns.DNSKEY
+	for _, rr := range reply.Answer {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || !strings.EqualFold(key.Hdr.Name, zone) {
+			continue
+		}
+
+		keyRRset = append(keyRRset, key)
+		keys = append(keys, key)
+		ttl = min(ttl, time.Duration(key.Hdr.Ttl)*time.Second)
+
+		if slices.ContainsFunc(trusted, func(rr dns.RR) bool { return matchesTrustedKey(key, rr) }) {
+			entryKeys = append(entryKeys, key)
+		}
+	}
+
+	if len(entryKeys) == 0 {
+		return nil, 0, fmt.Errorf("no trusted DNSKEY found for zone %s", zone)
+	}
+
+	// The DNSKEY RRset must be signed by one of the trusted keys.
+	entryZone := &dnssecZone{name: zone, keys: entryKeys}
+	if err := verifySignatures(rrsigs(reply.Answer, zone, dns.TypeDNSKEY), keyRRset, entryZone); err != nil {
+		return nil, 0, err
+	}
+
+	return keys, ttl, nil
+}
+
+func (v *dnssecValidator) query(ctx context.Context, name string, qType uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qType)
+	req.CheckingDisabled = true
+	req.SetEdns0(ednsUDPSize, true)
+
+	reply, err := v.upstream.Exchange(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s %s: %w", name, dns.TypeToString[qType], err)
+	}
+
+	if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("failed to query %s %s: %s",
+			name, dns.TypeToString[qType], dns.RcodeToString[reply.Rcode])
+	}
+
+	return reply, nil
+}
+
+func (v *dnssecValidator) cached(name string) (*dnssecZone, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	elem, ok := v.zones[name]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*dnssecZoneEntry)
+	if !time.Now().Before(entry.zone.expiresAt) {
+		v.lru.Remove(elem)
+		delete(v.zones, name)
+		return nil, false
+	}
+
+	v.lru.MoveToFront(elem)
+
+	return entry.zone, true
+}
+
+func (v *dnssecValidator) store(name string, zone *dnssecZone) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if elem, ok := v.zones[name]; ok {
+		elem.Value.(*dnssecZoneEntry).zone = zone
+		v.lru.MoveToFront(elem)
+		return
+	}
+
+	v.zones[name] = v.lru.PushFront(&dnssecZoneEntry{name: name, zone: zone})
+
+	// Evict the least recently used names.
+	for v.lru.Len() > v.maxZones {
+		elem := v.lru.Back()
+		v.lru.Remove(elem)
+		delete(v.zones, elem.Value.(*dnssecZoneEntry).name)
+	}
+}
+
+// verifySignatures checks that at least one of the signatures of an RRset was
+// made by the keys of the zone.
+func verifySignatures(sigs []*dns.RRSIG, rrset []dns.RR, zone *dnssecZone) error {
+	hdr := rrset[0].Header()
+
+	if len(sigs) == 0 {
+		return fmt.Errorf("missing signature for %s %s", hdr.Name, dns.TypeToString[hdr.Rrtype])
+	}
+
+	now := time.Now()
+
+	var err error
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, zone.name) {
+			err = fmt.Errorf("unexpected signer %s for %s %s", sig.SignerName, hdr.Name, dns.TypeToString[hdr.Rrtype])
+			continue
+		}
+
+		if !sig.ValidityPeriod(now) {
+			err = fmt.Errorf("expired signature for %s %s", hdr.Name, dns.TypeToString[hdr.Rrtype])
+			continue
+		}
+
+		err = fmt.Errorf("no key found for signature of %s %s", hdr.Name, dns.TypeToString[hdr.Rrtype])
+		for _, key := range zone.keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+
+			verifyErr := sig.Verify(key, rrset)
+			if verifyErr == nil {
+				return nil
+			}
+
+			err = fmt.Errorf("invalid signature for %s %s: %w", hdr.Name, dns.TypeToString[hdr.Rrtype], verifyErr)
+		}
+	}
+
+	return err
+}
+
+// matchesTrustedKey checks if a key matches a trusted DS or DNSKEY record.
+func matchesTrustedKey(key *dns.DNSKEY, trusted dns.RR) bool {
+	switch trusted := trusted.(type) {
+	case *dns.DS:
+		if key.KeyTag() != trusted.KeyTag || key.Algorithm != trusted.Algorithm {
+			return false
+		}
+
+		ds := key.ToDS(trusted.DigestType)
+		return ds != nil && strings.EqualFold(ds.Digest, trusted.Digest)
+	case *dns.DNSKEY:
+		return key.Flags == trusted.Flags && key.Algorithm == trusted.Algorithm &&
+			key.PublicKey == trusted.PublicKey
+	}
+
+	return false
+}
+
+// insecureDelegation checks if the NSEC/NSEC3 records in a negative response
+// to a DS query prove that the name is a delegation to an unsigned zone.
+func insecureDelegation(ns []dns.RR, name string) bool {
+	for _, rr := range ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, name) {
+				return slices.Contains(rr.TypeBitMap, dns.TypeNS) &&
+					!slices.Contains(rr.TypeBitMap, dns.TypeDS) &&
+					!slices.Contains(rr.TypeBitMap, dns.TypeSOA)
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return slices.Contains(rr.TypeBitMap, dns.TypeNS) &&
+					!slices.Contains(rr.TypeBitMap, dns.TypeDS) &&
+					!slices.Contains(rr.TypeBitMap, dns.TypeSOA)
+			}
+
+			// Opt-out (RFC 5155 Section 6) allows unsigned delegations to be
+			// skipped entirely.
+			if rr.Flags&0x01 != 0 && rr.Cover(name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// provesDenial checks if the NSEC/NSEC3 records in a negative response prove
+// that the name (or the type for the name) doesn't exist, including that no
+// wildcard could have matched the name (RFC 4035 Section 5.4, RFC 5155
+// Section 8).
+func provesDenial(ns []dns.RR, name string, qType uint16, nxdomain bool) bool {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+
+	if len(nsec3s) > 0 {
+		return provesNSEC3Denial(nsec3s, name, qType, nxdomain)
+	}
+
+	return provesNSECDenial(nsecs, name, qType, nxdomain)
+}
+
+func provesNSECDenial(nsecs []*dns.NSEC, name string, qType uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if strings.EqualFold(nsec.Hdr.Name, name) {
+				return deniesType(nsec.TypeBitMap, qType)
+			}
+		}
+	}
+
+	// The name doesn't exist, the NSEC record covering it also tells us the
+	// closest encloser, which is the longest common ancestor of the name with
+	// either end of the NSEC record.
+	var closestEncloser string
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+
+		closestEncloser = commonAncestor(name, nsec.Hdr.Name)
+		if ancestor := commonAncestor(name, nsec.NextDomain); dns.CountLabel(ancestor) > dns.CountLabel(closestEncloser) {
+			closestEncloser = ancestor
+		}
+		break
+	}
+	if closestEncloser == "" {
+		return false
+	}
+
+	// And no wildcard could have matched the name (or matched, but doesn't have
+	// the type).
+	wildcard := wildcardName(closestEncloser)
+	for _, nsec := range nsecs {
+		if nxdomain && nsecCovers(nsec, wildcard) {
+			return true
+		}
+
+		if !nxdomain && strings.EqualFold(nsec.Hdr.Name, wildcard) {
+			return deniesType(nsec.TypeBitMap, qType)
+		}
+	}
+
+	return false
+}
+
+func provesNSEC3Denial(nsec3s []*dns.NSEC3, name string, qType uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				return deniesType(nsec3.TypeBitMap, qType)
+			}
+		}
+	}
+
+	closestEncloser, nextCloser, ok := nsec3ClosestEncloser(nsec3s, name)
+	if !ok {
+		return false
+	}
+
+	wildcard := wildcardName(closestEncloser)
+	for _, nsec3 := range nsec3s {
+		if nxdomain && nsec3.Cover(wildcard) {
+			return true
+		}
+
+		if !nxdomain && nsec3.Match(wildcard) {
+			return deniesType(nsec3.TypeBitMap, qType)
+		}
+	}
+
+	// A missing DS record for an unsigned delegation, that was skipped using
+	// opt-out (RFC 5155 Section 8.6).
+	if !nxdomain && qType == dns.TypeDS {
+		return slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool {
+			return nsec3.Flags&0x01 != 0 && nsec3.Cover(nextCloser)
+		})
+	}
+
+	return false
+}
+
+// nsec3ClosestEncloser finds the closest encloser of a name, and the next
+// closer name, using NSEC3 records (RFC 5155 Section 8.3). The closest
+// encloser must exist, and the next closer name must not.
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, string, bool) {
+	matches := func(name string) bool {
+		return slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Match(name) })
+	}
+
+	covers := func(name string) bool {
+		return slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Cover(name) })
+	}
+
+	nextCloser := name
+	for {
+		off, end := dns.NextLabel(nextCloser, 0)
+		if end {
+			return "", "", false
+		}
+
+		closestEncloser := nextCloser[off:]
+		if matches(closestEncloser) {
+			return closestEncloser, nextCloser, covers(nextCloser)
+		}
+
+		nextCloser = closestEncloser
+	}
+}
+
+// wildcardExpansion checks if the signature of an RRset shows that it was
+// synthesized from a wildcard, returning the number of labels in the wildcard
+// (RFC 4035 Section 5.3.4).
+func wildcardExpansion(section, rrset []dns.RR) (uint8, bool) {
+	hdr := rrset[0].Header()
+
+	labels := dns.CountLabel(hdr.Name)
+	if strings.HasPrefix(hdr.Name, "*.") {
+		labels--
+	}
+
+	for _, sig := range rrsigs(section, hdr.Name, hdr.Rrtype) {
+		if int(sig.Labels) < labels {
+			return sig.Labels, true
+		}
+	}
+
+	return 0, false
+}
+
+// provesWildcardExpansion checks if the NSEC/NSEC3 records in a response prove
+// that a name synthesized from a wildcard doesn't exist itself.
+func provesWildcardExpansion(ns []dns.RR, name string, labels uint8) bool {
+	// The next closer name is the ancestor of the name, one label below the
+	// wildcard.
+	nameLabels := dns.SplitDomainName(name)
+	if int(labels) >= len(nameLabels) {
+		return false
+	}
+	nextCloser := dns.Fqdn(strings.Join(nameLabels[len(nameLabels)-int(labels)-1:], "."))
+
+	for _, rr := range ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Cover(nextCloser) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// deniesType checks if a type bitmap proves the type (or a CNAME) doesn't exist.
+func deniesType(typeBitMap []uint16, qType uint16) bool {
+	return !slices.Contains(typeBitMap, qType) && !slices.Contains(typeBitMap, dns.TypeCNAME)
+}
+
+// commonAncestor returns the longest common ancestor of two names.
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+
+	labels := dns.SplitDomainName(dns.CanonicalName(a))
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// wildcardName returns the wildcard name directly below a name.
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+
+	return "*." + name
+}
+
+// nsecCovers checks if a name falls between the owner and next name of an
+// NSEC record, in canonical order (RFC 4034 Section 6.1).
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+
+	if compareCanonical(owner, next) < 0 {
+		return compareCanonical(owner, name) < 0 && compareCanonical(name, next) < 0
+	}
+
+	// The last NSEC record in the zone wraps around to the apex.
+	return compareCanonical(owner, name) < 0 || compareCanonical(name, next) < 0
+}
+
+// compareCanonical compares two names in canonical DNS order.
+func compareCanonical(a, b string) int {
+	aLabels := dns.SplitDomainName(strings.ToLower(a))
+	bLabels := dns.SplitDomainName(strings.ToLower(b))
+
+	for i := 1; i <= min(len(aLabels), len(bLabels)); i++ {
+		if c := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(aLabels) - len(bLabels)
+}
+
+// splitRRsets groups the records in a section into RRsets, excluding any
+// signatures and OPT records.
+func splitRRsets(section []dns.RR) [][]dns.RR {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range section {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := rrsetKey{name: dns.CanonicalName(hdr.Name), rrtype: hdr.Rrtype}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	result := make([][]dns.RR, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, rrsets[key])
+	}
+
+	return result
+}
+
+// rrsigs returns the signatures in a section covering an RRset.
+func rrsigs(section []dns.RR, name string, rrtype uint16) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype && strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
+
+// stripDNSSECRecords removes DNSSEC records from a section for clients that
+// didn't set the DNSSEC OK bit, unless they explicitly asked for them
+// (RFC 4035 Section 3.2.1).
+func stripDNSSECRecords(section []dns.RR, qType uint16) []dns.RR {
+	var result []dns.RR
+	for _, rr := range section {
+		switch rrtype := rr.Header().Rrtype; rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rrtype != qType {
+				continue
+			}
+		}
+
+		result = append(result, rr)
+	}
+
+	return result
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
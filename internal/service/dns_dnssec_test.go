@@ -0,0 +1,390 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"crypto"
+	"encoding/base32"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSSECValidator(t *testing.T) {
+	z := newTestSignedZones(t)
+
+	validator := newDNSSECValidator(z, map[string][]dns.RR{
+		".": {z.rootKey.key.ToDS(dns.SHA256)},
+	})
+
+	t.Run("Secure", func(t *testing.T) {
+		secure, err := validator.Validate(context.Background(), question("example.org.", dns.TypeA), z.exchange("example.org.", dns.TypeA))
+		require.NoError(t, err)
+		require.True(t, secure)
+	})
+
+	t.Run("Secure NODATA", func(t *testing.T) {
+		secure, err := validator.Validate(context.Background(), question("example.org.", dns.TypeAAAA), z.exchange("example.org.", dns.TypeAAAA))
+		require.NoError(t, err)
+		require.True(t, secure)
+	})
+
+	t.Run("Insecure", func(t *testing.T) {
+		secure, err := validator.Validate(context.Background(), question("example.net.", dns.TypeA), z.exchange("example.net.", dns.TypeA))
+		require.NoError(t, err)
+		require.False(t, secure)
+	})
+
+	t.Run("Bogus", func(t *testing.T) {
+		reply := z.exchange("example.org.", dns.TypeA)
+		reply.Answer[0].(*dns.A).A = []byte{192, 0, 2, 99}
+
+		_, err := validator.Validate(context.Background(), question("example.org.", dns.TypeA), reply)
+		require.Error(t, err)
+	})
+
+	t.Run("Missing Signature", func(t *testing.T) {
+		reply := z.exchange("example.org.", dns.TypeA)
+		reply.Answer = stripDNSSECRecords(reply.Answer, dns.TypeA)
+
+		_, err := validator.Validate(context.Background(), question("example.org.", dns.TypeA), reply)
+		require.Error(t, err)
+	})
+
+	t.Run("Missing Denial", func(t *testing.T) {
+		reply := z.exchange("example.org.", dns.TypeAAAA)
+		reply.Ns = []dns.RR{reply.Ns[0], reply.Ns[1]}
+
+		_, err := validator.Validate(context.Background(), question("example.org.", dns.TypeAAAA), reply)
+		require.Error(t, err)
+	})
+}
+
+func TestDNSSECValidatorDenial(t *testing.T) {
+	z := newTestSignedZones(t)
+
+	validator := newDNSSECValidator(z, map[string][]dns.RR{
+		".": {z.rootKey.key.ToDS(dns.SHA256)},
+	})
+
+	nxdomain := func(name string, ns ...dns.RR) *dns.Msg {
+		reply := &dns.Msg{}
+		reply.SetQuestion(name, dns.TypeA)
+		reply.Response = true
+		reply.Rcode = dns.RcodeNameError
+		reply.Ns = append(z.signed(z.orgKey, z.orgSOA), ns...)
+		return reply
+	}
+
+	t.Run("NSEC", func(t *testing.T) {
+		nsec := func(owner, next string) []dns.RR {
+			return z.signed(z.orgKey, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: next,
+				TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+			})
+		}
+
+		// Covers the name, but not the wildcard at the closest encloser.
+		coversName := nsec("a.example.org.", "c.example.org.")
+		coversWildcard := nsec("example.org.", "a.example.org.")
+
+		_, err := validator.Validate(context.Background(), question("b.example.org.", dns.TypeA),
+			nxdomain("b.example.org.", coversName...))
+		require.ErrorContains(t, err, "missing proof of non-existence")
+
+		secure, err := validator.Validate(context.Background(), question("b.example.org.", dns.TypeA),
+			nxdomain("b.example.org.", append(coversName, coversWildcard...)...))
+		require.NoError(t, err)
+		require.True(t, secure)
+
+		// A wildcard that exists can't be denied.
+		_, err = validator.Validate(context.Background(), question("b.example.org.", dns.TypeA),
+			nxdomain("b.example.org.", nsec("*.example.org.", "c.example.org.")...))
+		require.Error(t, err)
+	})
+
+	t.Run("NSEC3", func(t *testing.T) {
+		// matching returns a NSEC3 record matching the name, and covering
+		// nothing else.
+		matching := func(name string) []dns.RR {
+			hash := dns.HashName(name, dns.SHA1, 0, "")
+			return z.signed(z.orgKey, &dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: hash + ".org.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				HashLength: 20,
+				NextDomain: nextHash(t, hash, 1),
+				TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG},
+			})
+		}
+
+		// covering returns a NSEC3 record covering only the name.
+		covering := func(name string) []dns.RR {
+			hash := dns.HashName(name, dns.SHA1, 0, "")
+			return z.signed(z.orgKey, &dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: nextHash(t, hash, -1) + ".org.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				HashLength: 20,
+				NextDomain: nextHash(t, hash, 1),
+				TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG},
+			})
+		}
+
+		closestEncloser := matching("example.org.")
+		nextCloser := covering("b.example.org.")
+		wildcard := covering("*.example.org.")
+
+		secure, err := validator.Validate(context.Background(), question("b.example.org.", dns.TypeA),
+			nxdomain("b.example.org.", slices.Concat(closestEncloser, nextCloser, wildcard)...))
+		require.NoError(t, err)
+		require.True(t, secure)
+
+		_, err = validator.Validate(context.Background(), question("b.example.org.", dns.TypeA),
+			nxdomain("b.example.org.", slices.Concat(closestEncloser, nextCloser)...))
+		require.ErrorContains(t, err, "missing proof of non-existence")
+
+		_, err = validator.Validate(context.Background(), question("b.example.org.", dns.TypeA),
+			nxdomain("b.example.org.", slices.Concat(nextCloser, wildcard)...))
+		require.ErrorContains(t, err, "missing proof of non-existence")
+	})
+
+	t.Run("Wildcard Expansion", func(t *testing.T) {
+		answer := z.signed(z.orgKey, mustRR(t, "*.example.org. 300 IN A 192.0.2.3"))
+		for _, rr := range answer {
+			rr.Header().Name = "b.example.org."
+		}
+
+		reply := &dns.Msg{}
+		reply.SetQuestion("b.example.org.", dns.TypeA)
+		reply.Response = true
+		reply.Answer = answer
+
+		_, err := validator.Validate(context.Background(), question("b.example.org.", dns.TypeA), reply)
+		require.ErrorContains(t, err, "wildcard expansion")
+
+		reply.Ns = z.signed(z.orgKey, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: "*.example.org.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: "c.example.org.",
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+		})
+
+		secure, err := validator.Validate(context.Background(), question("b.example.org.", dns.TypeA), reply)
+		require.NoError(t, err)
+		require.True(t, secure)
+	})
+}
+
+func TestDNSSECValidatorZoneCache(t *testing.T) {
+	validator := newDNSSECValidator(nil, nil)
+	validator.maxZones = 2
+
+	zone := &dnssecZone{name: ".", expiresAt: time.Now().Add(time.Hour)}
+
+	validator.store("a.example.org.", zone)
+	validator.store("b.example.org.", zone)
+
+	_, ok := validator.cached("a.example.org.")
+	require.True(t, ok)
+
+	// The least recently used name is evicted.
+	validator.store("c.example.org.", zone)
+	require.Len(t, validator.zones, 2)
+
+	_, ok = validator.cached("b.example.org.")
+	require.False(t, ok)
+
+	_, ok = validator.cached("a.example.org.")
+	require.True(t, ok)
+}
+
+func TestDNSHandlerDNSSEC(t *testing.T) {
+	z := newTestSignedZones(t)
+
+	validator := newDNSSECValidator(z, map[string][]dns.RR{
+		".": {z.rootKey.key.ToDS(dns.SHA256)},
+	})
+
+	handler := newDNSHandler(context.Background(), ".", upstreamResolver(nil, z, z, validator))
+
+	req := newTestRequest("example.org.", dns.TypeA)
+	req.SetEdns0(ednsUDPSize, true)
+
+	reply := serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.True(t, reply.AuthenticatedData)
+	require.Len(t, reply.Answer, 2)
+
+	// Clients that don't set the DO bit get neither the AD bit nor signatures.
+	reply = serveDNS(t, handler, newTestRequest("example.org.", dns.TypeA))
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.False(t, reply.AuthenticatedData)
+	require.Len(t, reply.Answer, 1)
+
+	z.records["example.org."][dns.TypeA].Answer[0].(*dns.A).A = []byte{192, 0, 2, 99}
+
+	reply = serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+	require.Empty(t, reply.Answer)
+
+	// Unless validation is disabled by the client.
+	req.CheckingDisabled = true
+
+	reply = serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.False(t, reply.AuthenticatedData)
+}
+
+type testZoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// testSignedZones is an upstream that serves a signed root zone, with a signed
+// delegation to "org." and an unsigned delegation to "net.".
+type testSignedZones struct {
+	t       *testing.T
+	rootKey *testZoneKey
+	orgKey  *testZoneKey
+	orgSOA  dns.RR
+	records map[string]map[uint16]*dns.Msg
+}
+
+func newTestSignedZones(t *testing.T) *testSignedZones {
+	z := &testSignedZones{
+		t:       t,
+		rootKey: newTestZoneKey(t, "."),
+		orgKey:  newTestZoneKey(t, "org."),
+		records: make(map[string]map[uint16]*dns.Msg),
+	}
+
+	z.add(".", dns.TypeDNSKEY, dns.RcodeSuccess, z.signed(z.rootKey, z.rootKey.key), nil)
+
+	z.add("org.", dns.TypeDS, dns.RcodeSuccess, z.signed(z.rootKey, z.orgKey.key.ToDS(dns.SHA256)), nil)
+	z.add("org.", dns.TypeDNSKEY, dns.RcodeSuccess, z.signed(z.orgKey, z.orgKey.key), nil)
+
+	orgSOA := mustRR(t, "org. 300 IN SOA ns.example.org. admin.example.org. 1 7200 3600 1209600 300")
+	z.orgSOA = orgSOA
+	exampleNSEC := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: "org.",
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+
+	example := mustRR(t, "example.org. 300 IN A 192.0.2.1")
+	z.add("example.org.", dns.TypeA, dns.RcodeSuccess, z.signed(z.orgKey, example), nil)
+	z.add("example.org.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+		append(z.signed(z.orgKey, orgSOA), z.signed(z.orgKey, exampleNSEC)...))
+	z.add("example.org.", dns.TypeDS, dns.RcodeSuccess, nil,
+		append(z.signed(z.orgKey, orgSOA), z.signed(z.orgKey, exampleNSEC)...))
+
+	rootSOA := mustRR(t, ". 300 IN SOA ns.root. admin.root. 1 7200 3600 1209600 300")
+	netNSEC := &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "net.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: ".",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	}
+
+	z.add("net.", dns.TypeDS, dns.RcodeSuccess, nil,
+		append(z.signed(z.rootKey, rootSOA), z.signed(z.rootKey, netNSEC)...))
+	z.add("example.net.", dns.TypeA, dns.RcodeSuccess, []dns.RR{mustRR(t, "example.net. 300 IN A 192.0.2.2")}, nil)
+
+	return z
+}
+
+func (z *testSignedZones) Exchange(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	reply := z.exchange(req.Question[0].Name, req.Question[0].Qtype)
+	reply.Id = req.Id
+	return reply, nil
+}
+
+func (z *testSignedZones) exchange(name string, qType uint16) *dns.Msg {
+	reply, ok := z.records[name][qType]
+	if !ok && qType == dns.TypeDS && dns.IsSubDomain("org.", name) {
+		// Names below "org." aren't delegations.
+		reply = &dns.Msg{}
+		reply.SetQuestion(name, qType)
+		reply.Response = true
+		reply.Ns = z.signed(z.orgKey, z.orgSOA)
+		return reply
+	}
+	if !ok {
+		z.t.Fatalf("unexpected query for %s %s", name, dns.TypeToString[qType])
+	}
+
+	return reply.Copy()
+}
+
+func (z *testSignedZones) add(name string, qType uint16, rcode int, answer, ns []dns.RR) {
+	reply := &dns.Msg{}
+	reply.SetQuestion(name, qType)
+	reply.Response = true
+	reply.Rcode = rcode
+	reply.Answer = answer
+	reply.Ns = ns
+
+	if z.records[name] == nil {
+		z.records[name] = make(map[uint16]*dns.Msg)
+	}
+	z.records[name][qType] = reply
+}
+
+// signed returns the record followed by its signature.
+func (z *testSignedZones) signed(key *testZoneKey, rr dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rr.Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+		Algorithm:  key.key.Algorithm,
+		KeyTag:     key.key.KeyTag(),
+		SignerName: key.key.Hdr.Name,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	require.NoError(z.t, sig.Sign(key.priv, []dns.RR{rr}))
+
+	return []dns.RR{rr, sig}
+}
+
+func newTestZoneKey(t *testing.T, zone string) *testZoneKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	return &testZoneKey{key: key, priv: priv.(crypto.Signer)}
+}
+
+// nextHash returns the base32hex encoded hash, offset by delta.
+func nextHash(t *testing.T, hash string, delta int) string {
+	b, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(hash)
+	require.NoError(t, err)
+
+	n := new(big.Int).SetBytes(b)
+	n.Add(n, big.NewInt(int64(delta)))
+	n.FillBytes(b)
+
+	return base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+func question(name string, qType uint16) dns.Question {
+	return dns.Question{Name: name, Qtype: qType, Qclass: dns.ClassINET}
+}
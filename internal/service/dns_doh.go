@@ -0,0 +1,169 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// dohHandler serves DNS-over-HTTPS (RFC 8484) queries using a DNS handler.
+type dohHandler struct {
+	handler dns.Handler
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(packed) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var err error
+		packed, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := &dns.Msg{}
+	if err := req.Unpack(packed); err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{
+		localAddr:  httpAddr(r.Context().Value(http.LocalAddrContextKey)),
+		remoteAddr: httpAddr(r.RemoteAddr),
+	}
+
+	h.handler.ServeDNS(rw, req)
+
+	if rw.reply == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	packed, err := rw.reply.Pack()
+	if err != nil {
+		slog.Error("Failed to pack DNS response", slog.Any("error", err))
+		http.Error(w, "failed to pack DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageContentType)
+	if maxAge, ok := minTTL(rw.reply); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+	}
+
+	if _, err := w.Write(packed); err != nil {
+		slog.Debug("Failed to write DNS-over-HTTPS response", slog.Any("error", err))
+	}
+}
+
+// dohResponseWriter captures the reply from a DNS handler.
+type dohResponseWriter struct {
+	localAddr  stdnet.Addr
+	remoteAddr stdnet.Addr
+	reply      *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() stdnet.Addr {
+	return w.localAddr
+}
+
+func (w *dohResponseWriter) RemoteAddr() stdnet.Addr {
+	return w.remoteAddr
+}
+
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.reply = msg
+	return nil
+}
+
+func (w *dohResponseWriter) Write(packed []byte) (int, error) {
+	msg := &dns.Msg{}
+	if err := msg.Unpack(packed); err != nil {
+		return 0, fmt.Errorf("failed to unpack DNS response: %w", err)
+	}
+
+	w.reply = msg
+	return len(packed), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return errors.New("TSIG is not supported")
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
+
+// httpAddr converts an address from the HTTP server into a TCP address.
+func httpAddr(addr any) stdnet.Addr {
+	switch addr := addr.(type) {
+	case stdnet.Addr:
+		return addr
+	case string:
+		addrPort, err := netip.ParseAddrPort(addr)
+		if err == nil {
+			return stdnet.TCPAddrFromAddrPort(addrPort)
+		}
+	}
+
+	return &stdnet.TCPAddr{}
+}
+
+// minTTL returns the smallest TTL of the records in a reply.
+func minTTL(reply *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	var found bool
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"log/slog"
+	stdnet "net"
+
+	"github.com/miekg/dns"
+)
+
+// The EDNS0 UDP payload size we advertise, and the largest UDP response we will
+// send. This avoids fragmentation with the default 1280 byte network MTU (it's
+// also the value recommended by DNS Flag Day 2020).
+const ednsUDPSize = 1232
+
+// ednsHandler wraps a DNS handler with EDNS0 (RFC 6891) support. It rejects
+// unsupported EDNS versions, adds an OPT record to responses for clients that
+// sent one, and truncates UDP responses that exceed the client's buffer size.
+func ednsHandler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if opt := req.IsEdns0(); opt != nil && opt.Version() != 0 {
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+			reply.SetEdns0(ednsUDPSize, false)
+			reply.Rcode = dns.RcodeBadVers
+
+			if err := w.WriteMsg(reply); err != nil {
+				slog.Debug("Failed to write DNS response", slog.Any("error", err))
+			}
+			return
+		}
+
+		next.ServeDNS(&ednsResponseWriter{ResponseWriter: w, req: req}, req)
+	})
+}
+
+// ednsResponseWriter adds EDNS0 handling to the replies written by a handler.
+type ednsResponseWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+}
+
+func (w *ednsResponseWriter) WriteMsg(reply *dns.Msg) error {
+	// OPT records are hop-by-hop, so replace any OPT records with our own.
+	extra := reply.Extra[:0]
+	for _, rr := range reply.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	reply.Extra = extra
+
+	size := dns.MinMsgSize
+	if opt := w.req.IsEdns0(); opt != nil {
+		// Mirror the DNSSEC OK bit (RFC 3225).
+		reply.SetEdns0(ednsUDPSize, opt.Do())
+
+		size = min(max(int(opt.UDPSize()), dns.MinMsgSize), ednsUDPSize)
+	}
+
+	if _, ok := w.RemoteAddr().(*stdnet.UDPAddr); ok {
+		// Sets the TC bit if the reply didn't fit, so the client will retry over
+		// TCP.
+		reply.Truncate(size)
+	} else {
+		reply.Compress = true
+	}
+
+	return w.ResponseWriter.WriteMsg(reply)
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// forwardZone is a zone whose queries are forwarded to a specific upstream.
+type forwardZone struct {
+	zone     string
+	upstream upstream
+}
+
+// forwardZones is a set of conditional forwarding rules, ordered from the most
+// to the least specific zone.
+type forwardZones []forwardZone
+
+// parseForwardZones parses forwarding rules of the form "zone=server", where
+// the server is an upstream specification (see parseUpstream). If a zone has
+// multiple rules, the servers are tried in order.
+func parseForwardZones(specs []string) (forwardZones, error) {
+	var zoneNames []string
+	servers := make(map[string][]string)
+
+	for _, spec := range specs {
+		zone, server, ok := strings.Cut(spec, "=")
+		if !ok || zone == "" || server == "" {
+			return nil, fmt.Errorf("invalid forwarding zone %q, expected zone=server", spec)
+		}
+
+		zone = dns.CanonicalName(zone)
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return nil, fmt.Errorf("invalid forwarding zone name %q", zone)
+		}
+
+		if _, ok := servers[zone]; !ok {
+			zoneNames = append(zoneNames, zone)
+		}
+
+		servers[zone] = append(servers[zone], strings.TrimSpace(server))
+	}
+
+	var zones forwardZones
+	for _, zone := range zoneNames {
+		var upstreams []upstream
+		for _, server := range servers[zone] {
+			upstream, err := parseUpstream(server)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse upstream server for zone %q: %w", zone, err)
+			}
+
+			upstreams = append(upstreams, upstream)
+		}
+
+		zones = append(zones, forwardZone{
+			zone:     zone,
+			upstream: newSequentialUpstream(upstreams...),
+		})
+	}
+
+	// Check the most specific zones first.
+	slices.SortStableFunc(zones, func(a, b forwardZone) int {
+		return dns.CountLabel(b.zone) - dns.CountLabel(a.zone)
+	})
+
+	return zones, nil
+}
+
+// Match returns the most specific forwarding zone containing the name.
+func (z forwardZones) Match(name string) (*forwardZone, bool) {
+	name = dns.CanonicalName(name)
+	for i := range z {
+		if dns.IsSubDomain(z[i].zone, name) {
+			return &z[i], true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// How many consecutive failures before an upstream is considered unhealthy.
+	upstreamUnhealthyThreshold = 3
+	// How many consecutive successful health checks before an unhealthy
+	// upstream is considered healthy again.
+	upstreamHealthyThreshold = 2
+	// The weight given to new latency samples.
+	upstreamLatencyWeight = 0.3
+	// How often to retry an unhealthy upstream with a client query, when
+	// active health checks are disabled.
+	upstreamRetryInterval = 30 * time.Second
+)
+
+// healthCheckedUpstream sends queries to the fastest healthy upstream, falling
+// back to the next fastest upstream if one fails. Upstreams that repeatedly
+// fail are removed from rotation until they pass health checks again.
+type healthCheckedUpstream struct {
+	upstreams []*upstreamHealth
+	// retryInterval is how often to try an unhealthy upstream first with a
+	// client query, so that it can recover without active health checks. Zero
+	// disables retries.
+	retryInterval time.Duration
+}
+
+// upstreamHealth tracks the health and latency of an upstream.
+type upstreamHealth struct {
+	upstream  upstream
+	mu        sync.Mutex
+	healthy   bool
+	failures  int
+	successes int
+	// lastTried is when the upstream last failed, or was last retried while
+	// unhealthy.
+	lastTried time.Time
+	// latency is a moving average of the upstream's response time.
+	latency time.Duration
+}
+
+func newHealthCheckedUpstream(upstreams ...upstream) *healthCheckedUpstream {
+	u := &healthCheckedUpstream{}
+	for _, upstream := range upstreams {
+		u.upstreams = append(u.upstreams, &upstreamHealth{
+			upstream: upstream,
+			healthy:  true,
+		})
+	}
+
+	return u
+}
+
+func (u *healthCheckedUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var errs []error
+	for _, h := range u.ordered() {
+		start := time.Now()
+
+		reply, err := h.upstream.Exchange(ctx, req)
+		if err == nil {
+			h.success(time.Since(start))
+			return reply, nil
+		}
+
+		errs = append(errs, err)
+
+		// Don't penalize the upstream if the client gave up.
+		if ctx.Err() != nil {
+			break
+		}
+
+		h.failure(err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (u *healthCheckedUpstream) String() string {
+	upstreams := make([]upstream, len(u.upstreams))
+	for i, h := range u.upstreams {
+		upstreams[i] = h.upstream
+	}
+
+	return joinUpstreams(upstreams)
+}
+
+// Run periodically probes each upstream, to measure its latency and to detect
+// when unhealthy upstreams have recovered.
+func (u *healthCheckedUpstream) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, h := range u.upstreams {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					h.probe(ctx)
+				}()
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// LogStats logs the health and latency of each upstream.
+func (u *healthCheckedUpstream) LogStats() {
+	for _, h := range u.upstreams {
+		h.mu.Lock()
+		healthy, latency := h.healthy, h.latency
+		h.mu.Unlock()
+
+		slog.Info("DNS upstream statistics",
+			slog.Any("upstream", h.upstream),
+			slog.Bool("healthy", healthy),
+			slog.Duration("latency", latency))
+	}
+}
+
+// ordered returns the upstreams ordered by health, and then latency.
+func (u *healthCheckedUpstream) ordered() []*upstreamHealth {
+	type candidate struct {
+		h       *upstreamHealth
+		healthy bool
+		retry   bool
+		latency time.Duration
+	}
+
+	now := time.Now()
+
+	candidates := make([]candidate, len(u.upstreams))
+	for i, h := range u.upstreams {
+		h.mu.Lock()
+		candidates[i] = candidate{h: h, healthy: h.healthy, latency: h.latency}
+
+		// Give the unhealthy upstream a chance to recover.
+		if !h.healthy && u.retryInterval > 0 && now.Sub(h.lastTried) >= u.retryInterval {
+			candidates[i].retry = true
+			h.lastTried = now
+		}
+		h.mu.Unlock()
+	}
+
+	// Unhealthy upstreams are only used as a last resort (unless they are
+	// being retried).
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		if a.retry != b.retry {
+			if a.retry {
+				return -1
+			}
+			return 1
+		}
+
+		if a.healthy != b.healthy {
+			if a.healthy {
+				return -1
+			}
+			return 1
+		}
+
+		return cmp.Compare(a.latency, b.latency)
+	})
+
+	ordered := make([]*upstreamHealth, len(candidates))
+	for i, c := range candidates {
+		ordered[i] = c.h
+	}
+
+	return ordered
+}
+
+func (h *upstreamHealth) probe(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+	defer cancel()
+
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+
+	start := time.Now()
+
+	reply, err := h.upstream.Exchange(ctx, req)
+	if err == nil && (reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("health check failed: %s", dns.RcodeToString[reply.Rcode])
+	}
+
+	if err != nil {
+		// Shutting down.
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+
+		h.failure(err)
+		return
+	}
+
+	h.success(time.Since(start))
+}
+
+func (h *upstreamHealth) success(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency = time.Duration((1-upstreamLatencyWeight)*float64(h.latency) + upstreamLatencyWeight*float64(latency))
+	}
+
+	h.failures = 0
+	h.successes++
+
+	if !h.healthy && h.successes >= upstreamHealthyThreshold {
+		h.healthy = true
+
+		slog.Info("DNS upstream is healthy again",
+			slog.Any("upstream", h.upstream), slog.Duration("latency", h.latency))
+	}
+}
+
+func (h *upstreamHealth) failure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.successes = 0
+	h.failures++
+	h.lastTried = time.Now()
+
+	if h.healthy && h.failures >= upstreamUnhealthyThreshold {
+		h.healthy = false
+
+		slog.Warn("DNS upstream is unhealthy, removing from rotation",
+			slog.Any("upstream", h.upstream), slog.Any("error", err))
+	}
+}
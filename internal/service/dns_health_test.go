@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckedUpstream(t *testing.T) {
+	primary := newTestUpstream()
+	primary.answers["."] = []dns.RR{mustRR(t, ". 300 IN NS a.root-servers.net.")}
+	primary.errors["example.com."] = errors.New("connection refused")
+
+	secondary := newTestUpstream()
+	secondary.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+
+	u := newHealthCheckedUpstream(primary, secondary)
+
+	// Make the secondary upstream slower.
+	u.upstreams[1].success(time.Second)
+
+	for i := 0; i < upstreamUnhealthyThreshold; i++ {
+		reply, err := u.Exchange(context.Background(), newTestRequest("example.com.", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, reply.Answer, 1)
+	}
+
+	require.Equal(t, upstreamUnhealthyThreshold, primary.calls)
+	require.False(t, u.upstreams[0].healthy)
+
+	// The unhealthy upstream is no longer used.
+	_, err := u.Exchange(context.Background(), newTestRequest("example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, upstreamUnhealthyThreshold, primary.calls)
+
+	// Until it passes enough health checks.
+	for i := 0; i < upstreamHealthyThreshold; i++ {
+		u.upstreams[0].probe(context.Background())
+	}
+
+	require.True(t, u.upstreams[0].healthy)
+	require.Equal(t, primary, u.ordered()[0].upstream)
+}
+
+func TestHealthCheckedUpstreamRetry(t *testing.T) {
+	primary := newTestUpstream()
+	primary.errors["example.com."] = errors.New("connection refused")
+
+	secondary := newTestUpstream()
+	secondary.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+
+	u := newHealthCheckedUpstream(primary, secondary)
+	u.retryInterval = upstreamRetryInterval
+
+	for i := 0; i < upstreamUnhealthyThreshold; i++ {
+		_, err := u.Exchange(context.Background(), newTestRequest("example.com.", dns.TypeA))
+		require.NoError(t, err)
+	}
+
+	require.False(t, u.upstreams[0].healthy)
+
+	// The unhealthy upstream isn't retried until the retry interval has passed.
+	_, err := u.Exchange(context.Background(), newTestRequest("example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, upstreamUnhealthyThreshold, primary.calls)
+
+	// Once the upstream has recovered, client queries add it back.
+	delete(primary.errors, "example.com.")
+	primary.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.2")}
+
+	for i := 0; i < upstreamHealthyThreshold; i++ {
+		u.upstreams[0].mu.Lock()
+		u.upstreams[0].lastTried = time.Now().Add(-upstreamRetryInterval)
+		u.upstreams[0].mu.Unlock()
+
+		reply, err := u.Exchange(context.Background(), newTestRequest("example.com.", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "192.0.2.2", reply.Answer[0].(*dns.A).A.String())
+	}
+
+	require.True(t, u.upstreams[0].healthy)
+}
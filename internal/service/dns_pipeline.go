@@ -0,0 +1,565 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/noisysockets/resolver"
+	"golang.org/x/net/publicsuffix"
+)
+
+// dnsQuery is a single question from a client request.
+type dnsQuery struct {
+	Question dns.Question
+	// Request is the original request from the client.
+	Request *dns.Msg
+	// RemoteAddr is the address of the client.
+	RemoteAddr stdnet.Addr
+	// ClientSubnet is the EDNS Client Subnet option to forward upstream (if any).
+	ClientSubnet *dns.EDNS0_SUBNET
+	Logger       *slog.Logger
+	Entry        *queryLogEntry
+}
+
+// resolverFunc answers a single question. The returned message contains the
+// rcode and records for the answer, and whether the answer is authoritative.
+// An error is answered with SERVFAIL.
+type resolverFunc func(ctx context.Context, q *dnsQuery) (*dns.Msg, error)
+
+// middleware wraps a resolverFunc to add additional behavior.
+type middleware func(next resolverFunc) resolverFunc
+
+// chain wraps a resolver with the given middlewares, the first middleware is
+// the outermost.
+func chain(resolve resolverFunc, middlewares ...middleware) resolverFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		resolve = middlewares[i](resolve)
+	}
+
+	return resolve
+}
+
+// newDNSHandler returns a DNS handler that answers each question in a request
+// independently using the resolver. Records from all answers are merged into
+// the response, and the rcode of the response is that of the first question
+// that wasn't answered successfully.
+func newDNSHandler(ctx context.Context, zone string, resolve resolverFunc) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		reply := &dns.Msg{}
+		reply.SetReply(req)
+		reply.RecursionAvailable = true
+
+		logger := slog.With(
+			slog.String("zone", zone),
+			slog.String("remoteAddr", w.RemoteAddr().String()),
+			slog.Int("id", int(req.Id)))
+
+		logger.Info("Resolving DNS query")
+
+		var dnssecOK bool
+		if opt := req.IsEdns0(); opt != nil {
+			dnssecOK = opt.Do()
+		}
+
+		authoritative := len(req.Question) > 0
+		authenticated := len(req.Question) > 0
+		for _, q := range req.Question {
+			query := &dnsQuery{
+				Question:   q,
+				Request:    req,
+				RemoteAddr: w.RemoteAddr(),
+				Logger: logger.With(
+					slog.String("name", q.Name),
+					slog.String("qType", dns.TypeToString[q.Qtype])),
+			}
+
+			answer, err := resolve(ctx, query)
+			if err != nil {
+				query.Logger.Warn("Failed to resolve DNS question", slog.Any("error", err))
+
+				answer = &dns.Msg{}
+				answer.Rcode = dns.RcodeServerFailure
+			}
+
+			if reply.Rcode == dns.RcodeSuccess {
+				reply.Rcode = answer.Rcode
+			}
+
+			if !dnssecOK {
+				answer.Answer = stripDNSSECRecords(answer.Answer, q.Qtype)
+				answer.Ns = stripDNSSECRecords(answer.Ns, q.Qtype)
+				answer.Extra = stripDNSSECRecords(answer.Extra, q.Qtype)
+			}
+
+			reply.Answer = append(reply.Answer, answer.Answer...)
+			reply.Ns = append(reply.Ns, answer.Ns...)
+
+			for _, rr := range answer.Extra {
+				// EDNS0 options are hop-by-hop.
+				if rr.Header().Rrtype != dns.TypeOPT {
+					reply.Extra = append(reply.Extra, rr)
+				}
+			}
+
+			authoritative = authoritative && answer.Authoritative
+			authenticated = authenticated && answer.AuthenticatedData
+		}
+
+		reply.Authoritative = authoritative
+		// Only set the AD bit for clients that understand it (RFC 6840 Section 5.7).
+		reply.AuthenticatedData = authenticated && (dnssecOK || req.AuthenticatedData)
+
+		if err := w.WriteMsg(reply); err != nil {
+			logger.Error("Failed to write DNS response", slog.Any("error", err))
+		}
+	})
+}
+
+// newAnswer returns an empty answer with the given rcode.
+func newAnswer(rcode int) *dns.Msg {
+	answer := &dns.Msg{}
+	answer.Rcode = rcode
+	return answer
+}
+
+// loggingMiddleware logs each question, and records it in the query log.
+func loggingMiddleware(queryLog *queryLog) middleware {
+	return func(next resolverFunc) resolverFunc {
+		return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+			q.Logger.Debug("Received DNS question")
+
+			q.Entry = queryLog.Begin(q.RemoteAddr, q.Question)
+
+			answer, err := next(ctx, q)
+			if err != nil {
+				q.Entry.Finish(dns.RcodeServerFailure, 0)
+				return nil, err
+			}
+
+			q.Logger.Debug("Answering DNS question",
+				slog.String("rcode", dns.RcodeToString[answer.Rcode]),
+				slog.Int("answers", len(answer.Answer)))
+
+			q.Entry.Finish(answer.Rcode, len(answer.Answer))
+
+			return answer, nil
+		}
+	}
+}
+
+// recursionMiddleware refuses queries that don't ask for recursion.
+func recursionMiddleware() middleware {
+	return func(next resolverFunc) resolverFunc {
+		return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+			if !q.Request.RecursionDesired {
+				q.Logger.Warn("Non-recursive query")
+
+				return newAnswer(dns.RcodeRefused), nil
+			}
+
+			return next(ctx, q)
+		}
+	}
+}
+
+// clientSubnetMiddleware forwards the EDNS Client Subnet (RFC 7871) option from
+// the client to the upstream. Without it, the option is stripped to protect the
+// privacy of clients.
+func clientSubnetMiddleware() middleware {
+	return func(next resolverFunc) resolverFunc {
+		return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+			if opt := q.Request.IsEdns0(); opt != nil {
+				for _, o := range opt.Option {
+					if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+						q.ClientSubnet = subnet
+					}
+				}
+			}
+
+			return next(ctx, q)
+		}
+	}
+}
+
+// policyMiddleware answers questions for blocked names.
+func policyMiddleware(blocklists *blocklists) middleware {
+	return func(next resolverFunc) resolverFunc {
+		return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+			rcode, records, path, blocked := blocklists.Apply(q.Question)
+			if !blocked {
+				return next(ctx, q)
+			}
+
+			q.Logger.Info("Blocked DNS question", slog.String("blocklist", path))
+			q.Entry.SetSource(querySourceBlocklist)
+
+			answer := newAnswer(rcode)
+			answer.Answer = records
+
+			return answer, nil
+		}
+	}
+}
+
+// cacheMiddleware answers questions from the cache, and caches the answers
+// from the next resolver.
+func cacheMiddleware(cache *dnsCache) middleware {
+	return func(next resolverFunc) resolverFunc {
+		return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+			// Answers to queries with a client subnet are specific to that subnet.
+			if q.ClientSubnet != nil {
+				return next(ctx, q)
+			}
+
+			if answer, origin := cache.Get(q.Question, q.Request.CheckingDisabled); answer != nil {
+				q.Logger.Debug("Answering DNS question from cache")
+				q.Entry.SetCached(origin)
+
+				return answer, nil
+			}
+
+			answer, err := next(ctx, q)
+			if err != nil {
+				return nil, err
+			}
+
+			cache.Put(q.Question, q.Request.CheckingDisabled, answer, q.Entry.Origin())
+
+			return answer, nil
+		}
+	}
+}
+
+// dns64Middleware synthesizes AAAA records from A records using DNS64
+// (RFC 6147), if there are no AAAA records for a name.
+func dns64Middleware(prefix netip.Prefix) middleware {
+	return func(next resolverFunc) resolverFunc {
+		return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+			answer, err := next(ctx, q)
+			if err != nil || q.Question.Qtype != dns.TypeAAAA || answer.Rcode != dns.RcodeSuccess {
+				return answer, err
+			}
+
+			for _, rr := range answer.Answer {
+				if rr.Header().Rrtype == dns.TypeAAAA {
+					return answer, nil
+				}
+			}
+
+			aQuery := *q
+			aQuery.Question.Qtype = dns.TypeA
+			aQuery.Logger = q.Logger.With(slog.Bool("dns64", true))
+
+			aAnswer, err := next(ctx, &aQuery)
+			if err != nil {
+				q.Logger.Debug("Failed to query A records for DNS64", slog.Any("error", err))
+				return answer, nil
+			}
+
+			if aAnswer.Rcode != dns.RcodeSuccess {
+				return answer, nil
+			}
+
+			var synthesized bool
+			var records []dns.RR
+			for _, rr := range aAnswer.Answer {
+				// Signatures for the A records don't cover the synthesized records.
+				if rr.Header().Rrtype == dns.TypeRRSIG {
+					continue
+				}
+
+				a, ok := rr.(*dns.A)
+				if !ok {
+					// Preserve the CNAME chain.
+					records = append(records, rr)
+					continue
+				}
+
+				hdr := a.Hdr
+				hdr.Rrtype = dns.TypeAAAA
+
+				records = append(records, &dns.AAAA{
+					Hdr:  hdr,
+					AAAA: stdnet.IP(synthesizeDNS64Addr(prefix, a.A).AsSlice()),
+				})
+				synthesized = true
+			}
+
+			if synthesized {
+				answer.Answer = records
+				// The authority section of the original answer would be a negative
+				// response, which is no longer relevant.
+				answer.Ns = nil
+				// Synthesized records can't be validated by the client (RFC 6147
+				// Section 5.5).
+				answer.AuthenticatedData = false
+			}
+
+			return answer, nil
+		}
+	}
+}
+
+func synthesizeDNS64Addr(prefix netip.Prefix, ip stdnet.IP) netip.Addr {
+	var ipv6Addr [16]byte
+	copy(ipv6Addr[:], prefix.Addr().AsSlice()[:12])
+	copy(ipv6Addr[12:], ip.To4())
+
+	return netip.AddrFrom16(ipv6Addr)
+}
+
+// upstreamResolver forwards questions to the matching forwarding zone, or to
+// the public or private upstream depending on whether the name is under a
+// public suffix. If a validator is provided, answers from the public upstream
+// are validated using DNSSEC.
+func upstreamResolver(forwardZones forwardZones, publicUpstream, privateUpstream upstream, validator *dnssecValidator) resolverFunc {
+	return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+		domain := dns.CanonicalName(q.Question.Name)
+		if domain != "." {
+			domain = strings.TrimRight(domain, ".")
+		}
+
+		var upstream upstream
+		var validate bool
+		if zone, ok := forwardZones.Match(q.Question.Name); ok {
+			q.Logger.Debug("Forwarded query", slog.String("forwardZone", zone.zone))
+			q.Entry.SetSource(querySourceForward)
+			q.Entry.SetZone(zone.zone)
+
+			upstream = zone.upstream
+		} else if _, icann := publicsuffix.PublicSuffix(domain); icann {
+			q.Logger.Debug("Public query")
+			q.Entry.SetSource(querySourcePublic)
+
+			upstream = publicUpstream
+			// Clients can opt out of validation with the CD bit (RFC 4035 Section 3.2.2).
+			validate = validator != nil && !q.Request.CheckingDisabled
+		} else {
+			q.Logger.Debug("Private query")
+			q.Entry.SetSource(querySourcePrivate)
+
+			upstream = privateUpstream
+		}
+
+		upstreamReq := &dns.Msg{}
+		upstreamReq.SetQuestion(q.Question.Name, q.Question.Qtype)
+		upstreamReq.Question[0].Qclass = q.Question.Qclass
+		// We do our own validation, so ask for bogus answers too.
+		upstreamReq.CheckingDisabled = q.Request.CheckingDisabled || validate
+		// Always ask for DNSSEC records, they are removed from the response for
+		// clients that didn't set the DO bit.
+		upstreamReq.SetEdns0(ednsUDPSize, true)
+
+		if q.ClientSubnet != nil {
+			upstreamOpt := upstreamReq.IsEdns0()
+			upstreamOpt.Option = append(upstreamOpt.Option, q.ClientSubnet)
+		}
+
+		answer, err := upstream.Exchange(ctx, upstreamReq)
+		if err != nil {
+			return nil, err
+		}
+
+		// We aren't authoritative for answers from upstream servers, and we only
+		// trust answers we have validated ourselves.
+		answer.Authoritative = false
+		answer.AuthenticatedData = false
+
+		if validate {
+			secure, err := validator.Validate(ctx, q.Question, answer)
+			if err != nil {
+				return nil, fmt.Errorf("DNSSEC validation failed: %w", err)
+			}
+
+			answer.AuthenticatedData = secure
+		}
+
+		return answer, nil
+	}
+}
+
+// hostResolver looks up the addresses of peers by name.
+type hostResolver interface {
+	LookupHost(host string) ([]string, error)
+}
+
+// authoritativeResolver answers questions for the network domain, using the
+// static records (if any) and the names of peers.
+func authoritativeResolver(hosts hostResolver, domain string, records *staticRecords) resolverFunc {
+	return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+		q.Entry.SetSource(querySourceAuthoritative)
+
+		answer := newAnswer(dns.RcodeSuccess)
+		answer.Authoritative = true
+
+		if records != nil {
+			if rrs, target, ok := records.Resolve(q.Question); ok {
+				// The CNAME chain might end at a peer name.
+				if target != "" && dns.IsSubDomain(domain, dns.CanonicalName(target)) {
+					if peerRecords, err := lookupPeerRecords(hosts, target, q.Question.Qtype); err == nil {
+						rrs = append(rrs, peerRecords...)
+					}
+				}
+
+				q.Logger.Debug("Answering DNS question from static records")
+
+				answer.Answer = rrs
+				answer.Extra = additionalRecords(hosts, records, domain, answer.Answer)
+
+				return answer, nil
+			}
+		}
+
+		switch q.Question.Qtype {
+		case dns.TypeA, dns.TypeAAAA:
+			rrs, err := lookupPeerRecords(hosts, q.Question.Name, q.Question.Qtype)
+			if err != nil {
+				if isNoSuchHost(err) {
+					// Names with static records of other types exist.
+					if records == nil || !records.Exists(q.Question.Name) {
+						answer.Rcode = dns.RcodeNameError
+					}
+					return answer, nil
+				}
+
+				return nil, err
+			}
+
+			answer.Answer = rrs
+		default:
+			if _, err := hosts.LookupHost(q.Question.Name); err != nil && isNoSuchHost(err) {
+				answer.Rcode = dns.RcodeNameError
+				return answer, nil
+			}
+
+			q.Logger.Warn("Unsupported DNS query type")
+
+			answer.Rcode = dns.RcodeNotImplemented
+		}
+
+		return answer, nil
+	}
+}
+
+// reverseResolver answers reverse (PTR) questions for the addresses of peers,
+// other questions are answered using the fallback resolver.
+func reverseResolver(reverseRecords func() *reverseRecords, fallback resolverFunc) resolverFunc {
+	return func(ctx context.Context, q *dnsQuery) (*dns.Msg, error) {
+		records := reverseRecords()
+		if records == nil {
+			return fallback(ctx, q)
+		}
+
+		name, ok := records.Lookup(q.Question.Name)
+		if !ok {
+			// Addresses outside of the network are resolved recursively.
+			return fallback(ctx, q)
+		}
+
+		q.Entry.SetSource(querySourceAuthoritative)
+
+		answer := newAnswer(dns.RcodeSuccess)
+		answer.Authoritative = true
+
+		if q.Question.Qtype == dns.TypePTR || q.Question.Qtype == dns.TypeANY {
+			answer.Answer = append(answer.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   q.Question.Name,
+					Rrtype: dns.TypePTR,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				Ptr: name,
+			})
+		}
+
+		return answer, nil
+	}
+}
+
+// lookupPeerRecords returns the A or AAAA records for a peer name.
+func lookupPeerRecords(hosts hostResolver, name string, qType uint16) ([]dns.RR, error) {
+	addrs, err := hosts.LookupHost(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for _, addr := range addrs {
+		ip := stdnet.ParseIP(addr)
+		if ip == nil {
+			slog.Warn("Failed to parse IP address", slog.String("address", addr))
+			continue
+		}
+
+		hdr := dns.RR_Header{
+			Name:   name,
+			Rrtype: qType,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		}
+
+		if ip.To4() != nil {
+			if qType == dns.TypeA {
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip})
+			}
+		} else if qType == dns.TypeAAAA {
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	return rrs, nil
+}
+
+// additionalRecords returns the addresses of any SRV or MX targets within the
+// network domain, so clients don't need to make a second query.
+func additionalRecords(hosts hostResolver, records *staticRecords, domain string, answer []dns.RR) []dns.RR {
+	var extra []dns.RR
+	seen := make(map[string]bool)
+
+	for _, rr := range answer {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			target = rr.Target
+		case *dns.MX:
+			target = rr.Mx
+		default:
+			continue
+		}
+
+		target = dns.CanonicalName(target)
+		if seen[target] || !dns.IsSubDomain(domain, target) {
+			continue
+		}
+		seen[target] = true
+
+		for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if rrs := records.Lookup(target, qType); len(rrs) > 0 {
+				extra = append(extra, rrs...)
+			} else if rrs, err := lookupPeerRecords(hosts, target, qType); err == nil {
+				extra = append(extra, rrs...)
+			}
+		}
+	}
+
+	return extra
+}
+
+func isNoSuchHost(err error) bool {
+	return strings.Contains(err.Error(), resolver.ErrNoSuchHost.Error())
+}
@@ -0,0 +1,417 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	"github.com/noisysockets/resolver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSHandlerMultipleQuestions(t *testing.T) {
+	upstream := newTestUpstream()
+	upstream.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+
+	handler := newDNSHandler(context.Background(), ".",
+		chain(upstreamResolver(nil, upstream, upstream, nil), recursionMiddleware()))
+
+	req := newTestRequest("example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "missing.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	req.Question = append(req.Question, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	reply := serveDNS(t, handler, req)
+
+	// Every question is answered, even after one of them fails.
+	require.Equal(t, dns.RcodeNameError, reply.Rcode)
+	require.Len(t, reply.Answer, 2)
+	require.Equal(t, 3, upstream.calls)
+	require.False(t, reply.Authoritative)
+	require.True(t, reply.RecursionAvailable)
+}
+
+func TestDNSHandlerResolverError(t *testing.T) {
+	upstream := newTestUpstream()
+	upstream.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+	upstream.errors["broken.example.com."] = errors.New("connection refused")
+
+	handler := newDNSHandler(context.Background(), ".",
+		chain(upstreamResolver(nil, upstream, upstream, nil), loggingMiddleware(nil)))
+
+	req := newTestRequest("broken.example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	reply := serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+	require.Len(t, reply.Answer, 1)
+	require.Equal(t, "example.com.", reply.Answer[0].Header().Name)
+}
+
+func TestDNSHandlerNonRecursive(t *testing.T) {
+	upstream := newTestUpstream()
+
+	handler := newDNSHandler(context.Background(), ".",
+		chain(upstreamResolver(nil, upstream, upstream, nil), recursionMiddleware()))
+
+	req := newTestRequest("example.com.", dns.TypeA)
+	req.RecursionDesired = false
+
+	reply := serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeRefused, reply.Rcode)
+	require.Zero(t, upstream.calls)
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	upstream := newTestUpstream()
+	upstream.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+
+	cache := newDNSCache(100, 0, time.Hour)
+
+	handler := newDNSHandler(context.Background(), ".",
+		chain(upstreamResolver(nil, upstream, upstream, nil), cacheMiddleware(cache)))
+
+	for i := 0; i < 2; i++ {
+		reply := serveDNS(t, handler, newTestRequest("example.com.", dns.TypeA))
+
+		require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		require.Len(t, reply.Answer, 1)
+	}
+
+	require.Equal(t, 1, upstream.calls)
+
+	hits, misses := cache.Stats()
+	require.Equal(t, uint64(1), hits)
+	require.Equal(t, uint64(1), misses)
+}
+
+func TestCacheMiddlewareSource(t *testing.T) {
+	publicUpstream := newTestUpstream()
+	publicUpstream.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+
+	privateUpstream := newTestUpstream()
+	privateUpstream.answers["db.internal."] = []dns.RR{mustRR(t, "db.internal. 300 IN A 10.0.0.1")}
+
+	resolve := chain(upstreamResolver(nil, publicUpstream, privateUpstream, nil),
+		cacheMiddleware(newDNSCache(100, 0, time.Hour)))
+
+	for _, tt := range []struct {
+		name   string
+		source string
+	}{
+		{name: "example.com.", source: querySourcePublic},
+		{name: "db.internal.", source: querySourcePrivate},
+	} {
+		for i := 0; i < 2; i++ {
+			q := &dnsQuery{
+				Question: dns.Question{Name: tt.name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				Request:  newTestRequest(tt.name, dns.TypeA),
+				Logger:   slog.Default(),
+				Entry:    &queryLogEntry{},
+			}
+
+			reply, err := resolve(context.Background(), q)
+			require.NoError(t, err)
+			require.Len(t, reply.Answer, 1)
+
+			// Cached answers keep the source of the original answer.
+			require.Equal(t, tt.source, q.Entry.Source)
+			require.Equal(t, i > 0, q.Entry.Cached)
+		}
+	}
+
+	require.Equal(t, 1, publicUpstream.calls)
+	require.Equal(t, 1, privateUpstream.calls)
+}
+
+func TestPolicyMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0o644))
+
+	blocklists, err := loadBlocklists([]string{path}, []netip.Addr{netip.MustParseAddr("192.0.2.254")})
+	require.NoError(t, err)
+
+	upstream := newTestUpstream()
+	upstream.answers["example.com."] = []dns.RR{mustRR(t, "example.com. 300 IN A 192.0.2.1")}
+
+	handler := newDNSHandler(context.Background(), ".",
+		chain(upstreamResolver(nil, upstream, upstream, nil), policyMiddleware(blocklists)))
+
+	req := newTestRequest("ads.example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	reply := serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Len(t, reply.Answer, 2)
+	require.Equal(t, "192.0.2.254", reply.Answer[0].(*dns.A).A.String())
+	require.Equal(t, "192.0.2.1", reply.Answer[1].(*dns.A).A.String())
+	require.Equal(t, 1, upstream.calls)
+}
+
+func TestDNS64Middleware(t *testing.T) {
+	upstream := newTestUpstream()
+	upstream.answers["ipv4only.example.com."] = []dns.RR{mustRR(t, "ipv4only.example.com. 300 IN A 192.0.2.1")}
+
+	handler := newDNSHandler(context.Background(), ".",
+		chain(upstreamResolver(nil, upstream, upstream, nil), dns64Middleware(netip.MustParsePrefix("64:ff9b::/96"))))
+
+	reply := serveDNS(t, handler, newTestRequest("ipv4only.example.com.", dns.TypeAAAA))
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Len(t, reply.Answer, 1)
+	require.Equal(t, "64:ff9b::c000:201", reply.Answer[0].(*dns.AAAA).AAAA.String())
+}
+
+func TestAuthoritativeResolver(t *testing.T) {
+	hosts := testHosts{
+		"a.my.nzzy.net.": {"100.64.0.1", "fd00::1"},
+	}
+
+	handler := newDNSHandler(context.Background(), "my.nzzy.net.",
+		authoritativeResolver(hosts, "my.nzzy.net.", nil))
+
+	req := newTestRequest("a.my.nzzy.net.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "a.my.nzzy.net.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+
+	reply := serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.True(t, reply.Authoritative)
+	require.Len(t, reply.Answer, 2)
+	require.Equal(t, dns.TypeA, reply.Answer[0].Header().Rrtype)
+	require.Equal(t, dns.TypeAAAA, reply.Answer[1].Header().Rrtype)
+
+	reply = serveDNS(t, handler, newTestRequest("b.my.nzzy.net.", dns.TypeA))
+
+	require.Equal(t, dns.RcodeNameError, reply.Rcode)
+	require.Empty(t, reply.Answer)
+}
+
+func TestAuthoritativeResolverStaticRecords(t *testing.T) {
+	hosts := testHosts{
+		"a.my.nzzy.net.": {"100.64.0.1", "fd00::1"},
+	}
+
+	path := filepath.Join(t.TempDir(), "records.zone")
+	require.NoError(t, os.WriteFile(path, []byte(`a 300 IN TXT "owner=ops"
+`), 0o644))
+
+	// Records from the config file are combined with the zone files.
+	records, err := loadStaticRecords("my.nzzy.net.", []string{`txt 300 IN TXT "static only"`}, path)
+	require.NoError(t, err)
+	require.Equal(t, 2, records.Len())
+
+	_, err = loadStaticRecords("my.nzzy.net.", []string{`example.com. 300 IN TXT "outside"`})
+	require.Error(t, err)
+
+	handler := newDNSHandler(context.Background(), "my.nzzy.net.",
+		authoritativeResolver(hosts, "my.nzzy.net.", records))
+
+	// Static records of other types don't hide the addresses of peers.
+	reply := serveDNS(t, handler, newTestRequest("a.my.nzzy.net.", dns.TypeA))
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Len(t, reply.Answer, 1)
+	require.Equal(t, "100.64.0.1", reply.Answer[0].(*dns.A).A.String())
+
+	reply = serveDNS(t, handler, newTestRequest("a.my.nzzy.net.", dns.TypeTXT))
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Len(t, reply.Answer, 1)
+	require.Equal(t, dns.TypeTXT, reply.Answer[0].Header().Rrtype)
+
+	// Names that only have static records of other types exist (NODATA).
+	reply = serveDNS(t, handler, newTestRequest("txt.my.nzzy.net.", dns.TypeAAAA))
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Empty(t, reply.Answer)
+}
+
+func TestReverseResolver(t *testing.T) {
+	records := newReverseRecords(&latestconfig.Config{
+		Name: "a",
+		IPs:  []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+	})
+
+	upstream := newTestUpstream()
+	upstream.answers["1.2.0.192.in-addr.arpa."] = []dns.RR{mustRR(t, "1.2.0.192.in-addr.arpa. 300 IN PTR example.com.")}
+
+	handler := newDNSHandler(context.Background(), "in-addr.arpa.",
+		reverseResolver(func() *reverseRecords { return records },
+			upstreamResolver(nil, upstream, upstream, nil)))
+
+	req := newTestRequest("1.0.64.100.in-addr.arpa.", dns.TypePTR)
+	req.Question = append(req.Question, dns.Question{Name: "1.2.0.192.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+
+	reply := serveDNS(t, handler, req)
+
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	// Only the first answer is authoritative.
+	require.False(t, reply.Authoritative)
+	require.Len(t, reply.Answer, 2)
+	require.Equal(t, "a.my.nzzy.net.", reply.Answer[0].(*dns.PTR).Ptr)
+	require.Equal(t, "example.com.", reply.Answer[1].(*dns.PTR).Ptr)
+	require.Equal(t, 1, upstream.calls)
+}
+
+func TestEDNSHandlerTruncation(t *testing.T) {
+	upstream := newTestUpstream()
+	for i := 0; i < 100; i++ {
+		upstream.answers["large.example.com."] = append(upstream.answers["large.example.com."],
+			mustRR(t, fmt.Sprintf("large.example.com. 300 IN TXT \"record %d padding padding padding\"", i)))
+	}
+
+	handler := ednsHandler(newDNSHandler(context.Background(), ".",
+		upstreamResolver(nil, upstream, upstream, nil)))
+
+	reply := serveDNS(t, handler, newTestRequest("large.example.com.", dns.TypeTXT))
+
+	require.True(t, reply.Truncated)
+	require.Nil(t, reply.IsEdns0())
+	reply.Compress = true
+	require.LessOrEqual(t, reply.Len(), dns.MinMsgSize)
+
+	req := newTestRequest("large.example.com.", dns.TypeTXT)
+	req.SetEdns0(4096, true)
+
+	reply = serveDNS(t, handler, req)
+
+	require.True(t, reply.Truncated)
+	require.NotNil(t, reply.IsEdns0())
+	require.True(t, reply.IsEdns0().Do())
+	reply.Compress = true
+	require.LessOrEqual(t, reply.Len(), ednsUDPSize)
+}
+
+// testUpstream answers queries from a fixed set of records.
+type testUpstream struct {
+	answers map[string][]dns.RR
+	errors  map[string]error
+	calls   int
+}
+
+func newTestUpstream() *testUpstream {
+	return &testUpstream{
+		answers: make(map[string][]dns.RR),
+		errors:  make(map[string]error),
+	}
+}
+
+func (u *testUpstream) Exchange(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	u.calls++
+
+	q := req.Question[0]
+	if err, ok := u.errors[q.Name]; ok {
+		return nil, err
+	}
+
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+
+	rrs, ok := u.answers[q.Name]
+	if !ok {
+		reply.Rcode = dns.RcodeNameError
+		return reply, nil
+	}
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == q.Qtype {
+			reply.Answer = append(reply.Answer, dns.Copy(rr))
+		}
+	}
+
+	return reply, nil
+}
+
+// testHosts is an in-memory peer name lookup.
+type testHosts map[string][]string
+
+func (h testHosts) LookupHost(host string) ([]string, error) {
+	addrs, ok := h[host]
+	if !ok {
+		return nil, resolver.ErrNoSuchHost
+	}
+
+	return addrs, nil
+}
+
+// testResponseWriter is an in-memory dns.ResponseWriter, for a UDP client
+// unless a remote address is given.
+type testResponseWriter struct {
+	remoteAddr stdnet.Addr
+	reply      *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() stdnet.Addr {
+	return &stdnet.UDPAddr{IP: stdnet.IPv6loopback, Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() stdnet.Addr {
+	if w.remoteAddr != nil {
+		return w.remoteAddr
+	}
+
+	return &stdnet.UDPAddr{IP: stdnet.IPv6loopback, Port: 12345}
+}
+
+func (w *testResponseWriter) WriteMsg(reply *dns.Msg) error {
+	// Round trip the reply to make sure it is valid on the wire.
+	buf, err := reply.Pack()
+	if err != nil {
+		return err
+	}
+
+	w.reply = &dns.Msg{}
+	return w.reply.Unpack(buf)
+}
+
+func (w *testResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+func serveDNS(t *testing.T, handler dns.Handler, req *dns.Msg) *dns.Msg {
+	w := &testResponseWriter{}
+	handler.ServeDNS(w, req)
+
+	require.NotNil(t, w.reply)
+	require.Equal(t, req.Id, w.reply.Id)
+
+	return w.reply
+}
+
+func newTestRequest(name string, qType uint16) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, qType)
+	return req
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	require.NoError(t, err)
+	return rr
+}
@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"github.com/miekg/dns"
+	"github.com/noisysockets/noisysockets/config"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+)
+
+// reverseRecords maps the addresses of this peer, and its peers, back to their
+// names in the network domain.
+type reverseRecords struct {
+	names map[string]string
+}
+
+func newReverseRecords(conf *latestconfig.Config) *reverseRecords {
+	domain := config.DefaultDomain
+	if conf.DNS != nil && conf.DNS.Domain != "" {
+		domain = dns.Fqdn(conf.DNS.Domain)
+	}
+
+	r := &reverseRecords{
+		names: make(map[string]string),
+	}
+
+	r.add(conf.Name, domain, conf.IPs)
+
+	for _, peerConf := range conf.Peers {
+		r.add(peerConf.Name, domain, peerConf.IPs)
+	}
+
+	return r
+}
+
+func (r *reverseRecords) add(name, domain string, addrs []netip.Addr) {
+	// Peer names are optional.
+	if name == "" {
+		return
+	}
+
+	for _, addr := range addrs {
+		reverseName, err := dns.ReverseAddr(addr.Unmap().String())
+		if err != nil {
+			slog.Warn("Failed to get reverse name for address",
+				slog.String("address", addr.String()), slog.Any("error", err))
+			continue
+		}
+
+		r.names[reverseName] = dns.Fqdn(name + "." + domain)
+	}
+}
+
+// Lookup returns the name for a reverse (in-addr.arpa/ip6.arpa) name.
+func (r *reverseRecords) Lookup(reverseName string) (string, bool) {
+	name, ok := r.names[dns.CanonicalName(reverseName)]
+	return name, ok
+}
+
+// LookupAddr returns the name for an address, or an empty string if unknown.
+func (r *reverseRecords) LookupAddr(addr netip.Addr) string {
+	reverseName, err := dns.ReverseAddr(addr.Unmap().String())
+	if err != nil {
+		return ""
+	}
+
+	name, _ := r.Lookup(reverseName)
+	return name
+}
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// How a DNS question was answered.
+const (
+	querySourceAuthoritative = "authoritative"
+	querySourceBlocklist     = "blocklist"
+	querySourceForward       = "forward"
+	querySourcePrivate       = "private"
+	querySourcePublic        = "public"
+)
+
+// queryLog is an audit log of DNS queries, written as JSON lines.
+type queryLog struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	enc    *json.Encoder
+	lookup func(addr netip.Addr) string
+}
+
+// newQueryLog returns a query log that writes to the given path (or stdout if
+// the path is "-"). Log files are rotated once they reach maxSizeMB, and at
+// most maxBackups old log files are retained. The lookup function is used to
+// resolve client addresses to peer names.
+func newQueryLog(path string, maxSizeMB, maxBackups int, lookup func(addr netip.Addr) string) *queryLog {
+	var w io.WriteCloser
+	if path == "-" {
+		w = nopCloser{os.Stdout}
+	} else {
+		w = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSizeMB,
+			MaxBackups: maxBackups,
+		}
+	}
+
+	return &queryLog{
+		w:      w,
+		enc:    json.NewEncoder(w),
+		lookup: lookup,
+	}
+}
+
+func (l *queryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Close()
+}
+
+// Begin starts a query log entry for a question. It is safe to call on a nil
+// query log, in which case a nil entry is returned.
+func (l *queryLog) Begin(remoteAddr stdnet.Addr, q dns.Question) *queryLogEntry {
+	if l == nil {
+		return nil
+	}
+
+	e := &queryLogEntry{
+		l:     l,
+		start: time.Now(),
+		Name:  q.Name,
+		Type:  dns.TypeToString[q.Qtype],
+	}
+
+	if addrPort, err := netip.ParseAddrPort(remoteAddr.String()); err == nil {
+		e.Client = addrPort.Addr().Unmap()
+		e.Peer = l.lookup(e.Client)
+	}
+
+	if _, ok := remoteAddr.(*stdnet.UDPAddr); ok {
+		e.Protocol = "udp"
+	} else {
+		e.Protocol = "tcp"
+	}
+
+	return e
+}
+
+// queryLogEntry is a single entry in the query log.
+type queryLogEntry struct {
+	l     *queryLog
+	start time.Time
+
+	Time time.Time `json:"time"`
+	// Client is the mesh address of the client.
+	Client netip.Addr `json:"client"`
+	// Peer is the name of the client peer (if known).
+	Peer     string `json:"peer,omitempty"`
+	Protocol string `json:"protocol"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Rcode    string `json:"rcode"`
+	Answers  int    `json:"answers"`
+	// Source is how the question was answered (eg. public, private), for
+	// cached answers this is how the question was originally answered.
+	Source string `json:"source,omitempty"`
+	// Zone is the matching forwarding zone (if any).
+	Zone string `json:"zone,omitempty"`
+	// Cached is whether the answer came from the cache.
+	Cached    bool    `json:"cached"`
+	LatencyMS float64 `json:"latencyMs"`
+}
+
+// SetSource records how the question was answered.
+func (e *queryLogEntry) SetSource(source string) {
+	if e != nil {
+		e.Source = source
+	}
+}
+
+// SetZone records the forwarding zone used to answer the question.
+func (e *queryLogEntry) SetZone(zone string) {
+	if e != nil {
+		e.Zone = zone
+	}
+}
+
+// queryOrigin is how a question was answered, it is stored alongside cached
+// answers.
+type queryOrigin struct {
+	source string
+	zone   string
+}
+
+// Origin returns how the question was answered.
+func (e *queryLogEntry) Origin() queryOrigin {
+	if e == nil {
+		return queryOrigin{}
+	}
+
+	return queryOrigin{source: e.Source, zone: e.Zone}
+}
+
+// SetCached records that the question was answered from the cache, and how it
+// was originally answered.
+func (e *queryLogEntry) SetCached(origin queryOrigin) {
+	if e != nil {
+		e.Cached = true
+		e.Source = origin.source
+		e.Zone = origin.zone
+	}
+}
+
+// Finish writes the entry to the query log.
+func (e *queryLogEntry) Finish(rcode, answers int) {
+	if e == nil {
+		return
+	}
+
+	e.Time = e.start.UTC()
+	e.Rcode = dns.RcodeToString[rcode]
+	e.Answers = answers
+	e.LatencyMS = float64(time.Since(e.start).Microseconds()) / 1000
+
+	e.l.mu.Lock()
+	defer e.l.mu.Unlock()
+
+	if err := e.l.enc.Encode(e); err != nil {
+		slog.Warn("Failed to write query log entry", slog.Any("error", err))
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// How long to keep track of a client after its last query.
+	rateLimitClientIdleTimeout = 5 * time.Minute
+	// How often to warn about a client that is being rate limited.
+	rateLimitWarnInterval = time.Minute
+)
+
+// rateLimiter limits the rate of queries, and the number of concurrent queries,
+// from each client.
+type rateLimiter struct {
+	rate        rate.Limit
+	burst       int
+	maxInFlight int
+	mu          sync.Mutex
+	clients     map[netip.Addr]*rateLimitedClient
+}
+
+type rateLimitedClient struct {
+	limiter    *rate.Limiter
+	inFlight   int
+	lastSeen   time.Time
+	lastWarned time.Time
+}
+
+// newRateLimiter returns a rate limiter that allows each client to make
+// queriesPerSecond queries per second (with bursts of up to burst queries),
+// and up to maxInFlight concurrent queries. A limit of zero disables the
+// corresponding check.
+func newRateLimiter(queriesPerSecond float64, burst, maxInFlight int) *rateLimiter {
+	limit := rate.Inf
+	if queriesPerSecond > 0 {
+		limit = rate.Limit(queriesPerSecond)
+
+		if burst <= 0 {
+			burst = max(1, int(2*queriesPerSecond))
+		}
+	}
+
+	return &rateLimiter{
+		rate:        limit,
+		burst:       burst,
+		maxInFlight: maxInFlight,
+		clients:     make(map[netip.Addr]*rateLimitedClient),
+	}
+}
+
+// Handler wraps a DNS handler with rate limiting. Queries over the rate limit
+// are answered with an empty truncated response when using UDP (so that the
+// client retries over TCP), or REFUSED otherwise. Queries over the concurrent
+// query limit are always answered with REFUSED.
+func (l *rateLimiter) Handler(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		addrPort, err := netip.ParseAddrPort(w.RemoteAddr().String())
+		if err != nil {
+			next.ServeDNS(w, req)
+			return
+		}
+		addr := addrPort.Addr().Unmap()
+
+		allowed, overRate := l.acquire(addr)
+		if !allowed {
+			reply := &dns.Msg{}
+			reply.SetReply(req)
+
+			_, isUDP := w.RemoteAddr().(*stdnet.UDPAddr)
+			if overRate && isUDP {
+				reply.Truncated = true
+			} else {
+				reply.Rcode = dns.RcodeRefused
+			}
+
+			if err := w.WriteMsg(reply); err != nil {
+				slog.Debug("Failed to write DNS response", slog.Any("error", err))
+			}
+			return
+		}
+		defer l.release(addr)
+
+		next.ServeDNS(w, req)
+	})
+}
+
+// Run periodically forgets about idle clients.
+func (l *rateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitClientIdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			for addr, client := range l.clients {
+				if client.inFlight == 0 && time.Since(client.lastSeen) > rateLimitClientIdleTimeout {
+					delete(l.clients, addr)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// acquire checks if a query from the client is allowed, if it is not, overRate
+// indicates whether the rate limit (rather than the concurrency limit) was
+// exceeded.
+func (l *rateLimiter) acquire(addr netip.Addr) (allowed, overRate bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, ok := l.clients[addr]
+	if !ok {
+		client = &rateLimitedClient{
+			limiter: rate.NewLimiter(l.rate, l.burst),
+		}
+		l.clients[addr] = client
+	}
+
+	now := time.Now()
+	client.lastSeen = now
+
+	if l.maxInFlight > 0 && client.inFlight >= l.maxInFlight {
+		l.warn(addr, client, "Too many concurrent DNS queries from client")
+		return false, false
+	}
+
+	if !client.limiter.AllowN(now, 1) {
+		l.warn(addr, client, "Rate limiting DNS client")
+		return false, true
+	}
+
+	client.inFlight++
+
+	return true, false
+}
+
+func (l *rateLimiter) release(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if client, ok := l.clients[addr]; ok {
+		client.inFlight--
+	}
+}
+
+func (l *rateLimiter) warn(addr netip.Addr, client *rateLimitedClient, msg string) {
+	if time.Since(client.lastWarned) < rateLimitWarnInterval {
+		return
+	}
+	client.lastWarned = time.Now()
+
+	slog.Warn(msg, slog.String("client", addr.String()))
+}
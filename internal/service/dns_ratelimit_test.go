@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"bytes"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	logs := captureLogs(t)
+
+	limiter := newRateLimiter(1, 2, 0)
+	handler := limiter.Handler(testAnswerHandler(nil))
+
+	udpClient := &stdnet.UDPAddr{IP: stdnet.ParseIP("fd00::2"), Port: 12345}
+	tcpClient := &stdnet.TCPAddr{IP: stdnet.ParseIP("fd00::3"), Port: 12345}
+
+	for _, remoteAddr := range []stdnet.Addr{udpClient, tcpClient} {
+		// Up to the burst size is allowed.
+		for i := 0; i < 2; i++ {
+			reply := serveRateLimited(t, handler, remoteAddr)
+
+			require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+			require.False(t, reply.Truncated)
+			require.Len(t, reply.Answer, 1)
+		}
+
+		for i := 0; i < 3; i++ {
+			reply := serveRateLimited(t, handler, remoteAddr)
+
+			require.Empty(t, reply.Answer)
+			if remoteAddr == udpClient {
+				// UDP clients are told to retry over TCP.
+				require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+				require.True(t, reply.Truncated)
+			} else {
+				require.Equal(t, dns.RcodeRefused, reply.Rcode)
+				require.False(t, reply.Truncated)
+			}
+		}
+	}
+
+	// Each rate limited client is only warned about once per interval.
+	require.Equal(t, 2, strings.Count(logs.String(), "Rate limiting DNS client"))
+
+	limiter.mu.Lock()
+	limiter.clients[netip.MustParseAddr("fd00::2")].lastWarned = time.Now().Add(-rateLimitWarnInterval)
+	limiter.mu.Unlock()
+
+	reply := serveRateLimited(t, handler, udpClient)
+	require.True(t, reply.Truncated)
+
+	require.Equal(t, 3, strings.Count(logs.String(), "Rate limiting DNS client"))
+}
+
+func TestRateLimiterConcurrency(t *testing.T) {
+	logs := captureLogs(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var blocking bool
+	limiter := newRateLimiter(0, 0, 1)
+	handler := limiter.Handler(testAnswerHandler(func() {
+		if blocking {
+			close(started)
+			<-release
+		}
+	}))
+
+	client := &stdnet.UDPAddr{IP: stdnet.ParseIP("fd00::2"), Port: 12345}
+
+	blocking = true
+	done := make(chan *dns.Msg)
+	go func() {
+		w := &testResponseWriter{remoteAddr: client}
+		handler.ServeDNS(w, newTestRequest("example.com.", dns.TypeA))
+		done <- w.reply
+	}()
+	<-started
+	blocking = false
+
+	// Queries over the concurrency limit are refused, even over UDP.
+	reply := serveRateLimited(t, handler, client)
+	require.Equal(t, dns.RcodeRefused, reply.Rcode)
+	require.False(t, reply.Truncated)
+
+	// Other clients are unaffected.
+	reply = serveRateLimited(t, handler, &stdnet.UDPAddr{IP: stdnet.ParseIP("fd00::3"), Port: 12345})
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Len(t, reply.Answer, 1)
+
+	close(release)
+	reply = <-done
+	require.NotNil(t, reply)
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	// Once the query has finished, the client can query again.
+	reply = serveRateLimited(t, handler, client)
+	require.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Len(t, reply.Answer, 1)
+
+	require.Equal(t, 1, strings.Count(logs.String(), "Too many concurrent DNS queries from client"))
+}
+
+// testAnswerHandler answers every query with a single record, calling
+// onQuery (if any) before answering.
+func testAnswerHandler(onQuery func()) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if onQuery != nil {
+			onQuery()
+		}
+
+		reply := &dns.Msg{}
+		reply.SetReply(req)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   stdnet.ParseIP("192.0.2.1"),
+		})
+
+		_ = w.WriteMsg(reply)
+	})
+}
+
+func serveRateLimited(t *testing.T, handler dns.Handler, remoteAddr stdnet.Addr) *dns.Msg {
+	w := &testResponseWriter{remoteAddr: remoteAddr}
+	handler.ServeDNS(w, newTestRequest("example.com.", dns.TypeA))
+
+	require.NotNil(t, w.reply)
+	return w.reply
+}
+
+// captureLogs redirects the default logger to a buffer for the duration of
+// the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var logs bytes.Buffer
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+	})
+
+	return &logs
+}
@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The maximum number of CNAMEs to follow when resolving static records.
+const maxCNAMEChain = 8
+
+// staticRecords is a set of user-defined records for the network domain.
+type staticRecords struct {
+	records map[string][]dns.RR
+}
+
+// loadStaticRecords reads records from zone files (RFC 1035 master file
+// format), and from a list of records in the same format. Relative names are
+// relative to the given origin, and all records must be within the origin.
+func loadStaticRecords(origin string, records []string, paths ...string) (*staticRecords, error) {
+	r := &staticRecords{
+		records: make(map[string][]dns.RR),
+	}
+
+	for _, path := range paths {
+		if err := r.loadFile(origin, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(records) > 0 {
+		if err := r.load(origin, "config", strings.NewReader(strings.Join(records, "\n"))); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *staticRecords) loadFile(origin, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open records file: %w", err)
+	}
+	defer f.Close()
+
+	return r.load(origin, path, f)
+}
+
+func (r *staticRecords) load(origin, source string, rd io.Reader) error {
+	zp := dns.NewZoneParser(rd, origin, source)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			return fmt.Errorf("record %q in %s is outside of the network domain %q", name, source, origin)
+		}
+
+		r.records[name] = append(r.records[name], rr)
+	}
+
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("failed to parse records: %w", err)
+	}
+
+	return nil
+}
+
+// Len returns the number of records.
+func (r *staticRecords) Len() int {
+	var n int
+	for _, rrs := range r.records {
+		n += len(rrs)
+	}
+
+	return n
+}
+
+// Lookup returns a copy of the records of the given type for a name, or all
+// records for the name if qType is ANY.
+func (r *staticRecords) Lookup(name string, qType uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range r.records[dns.CanonicalName(name)] {
+		if qType == dns.TypeANY || rr.Header().Rrtype == qType {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+
+	return rrs
+}
+
+// Exists returns whether there are any static records for a name.
+func (r *staticRecords) Exists(name string) bool {
+	_, exists := r.records[dns.CanonicalName(name)]
+	return exists
+}
+
+// Resolve answers a question using the static records, following any CNAMEs.
+// If the CNAME chain leaves the static records, the name of the final target
+// is returned so that the caller can continue resolution. The ok result is
+// false if there are no static records for the name.
+//
+// Address (A/AAAA) questions for names that only have static records of other
+// types are also left to the caller, so that static records don't hide the
+// addresses of peers.
+func (r *staticRecords) Resolve(q dns.Question) (answer []dns.RR, target string, ok bool) {
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		if _, exists := r.records[dns.CanonicalName(name)]; !exists {
+			return answer, name, len(answer) > 0
+		}
+
+		if rrs := r.Lookup(name, q.Qtype); len(rrs) > 0 || q.Qtype == dns.TypeCNAME {
+			return append(answer, rrs...), "", true
+		}
+
+		cnames := r.Lookup(name, dns.TypeCNAME)
+		if len(cnames) == 0 {
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+				return answer, name, len(answer) > 0
+			}
+
+			// The name exists, but has no records of the requested type.
+			return answer, "", true
+		}
+
+		answer = append(answer, cnames[0])
+		name = cnames[0].(*dns.CNAME).Target
+	}
+
+	return answer, "", true
+}
@@ -11,39 +11,190 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	stdnet "net"
+	"net/http"
 	"net/netip"
-	"strings"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"time"
 
-	stdnet "net"
-
 	"github.com/miekg/dns"
 	"github.com/noisysockets/network"
-	"github.com/noisysockets/noisysockets/types"
-	"github.com/noisysockets/resolver"
-	"golang.org/x/net/publicsuffix"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
 	"golang.org/x/sync/errgroup"
 )
 
-var _ Service = (*DNSService)(nil)
+var (
+	_ Service      = (*DNSService)(nil)
+	_ Configurable = (*DNSService)(nil)
+)
+
+// How often to log DNS cache, blocklist, and upstream statistics.
+const statsInterval = 5 * time.Minute
+
+// DNSServiceConfig is the configuration for the DNS service.
+type DNSServiceConfig struct {
+	// ListenAddresses is an optional list of addresses on the network to listen
+	// for queries on (eg. "fd00::1", ":5353"), by default port 53 on all
+	// addresses.
+	ListenAddresses []string
+	// HostListenAddresses is an optional list of addresses on the host to
+	// listen for queries on (eg. "127.0.0.1:5353").
+	HostListenAddresses []string
+	// EnableNAT64 enables the synthesis of AAAA records using DNS64.
+	EnableNAT64 bool
+	// NAT64Prefix is the prefix used for DNS64 synthesized addresses.
+	NAT64Prefix netip.Prefix
+	// PublicUpstreamServers is an optional list of upstream servers to use for
+	// public queries, by default the system nameservers are used.
+	PublicUpstreamServers []string
+	// HealthCheckInterval is how often to probe the public upstream
+	// servers, zero disables active health checks.
+	HealthCheckInterval time.Duration
+	// ForwardZones is an optional list of conditional forwarding rules, of the
+	// form "zone=server".
+	ForwardZones []string
+	// CacheSize is the maximum number of responses to cache, zero disables
+	// caching.
+	CacheSize int
+	// CacheMinTTL is the minimum time to cache a response for.
+	CacheMinTTL time.Duration
+	// CacheMaxTTL is the maximum time to cache a response for, zero means no
+	// limit.
+	CacheMaxTTL time.Duration
+	// RecordFiles is an optional list of zone files containing additional
+	// records (eg. CNAME, TXT, SRV) for the network domain.
+	RecordFiles []string
+	// Records is an optional list of additional records for the network
+	// domain, in zone file format (eg. "api IN CNAME resolver").
+	Records []string
+	// Blocklists is an optional list of hosts format or RPZ files containing
+	// names to block.
+	Blocklists []string
+	// BlocklistSinkhole is an optional list of addresses to answer with for
+	// blocked names, by default NXDOMAIN is returned.
+	BlocklistSinkhole []netip.Addr
+	// BlocklistReload is how often to check blocklists for changes.
+	BlocklistReload time.Duration
+	// QueryLogPath is an optional path to write a JSON lines query log to, or
+	// "-" for stdout.
+	QueryLogPath string
+	// QueryLogMaxSize is the size in megabytes at which the query log is
+	// rotated.
+	QueryLogMaxSize int
+	// QueryLogMaxBackups is the number of rotated query logs to retain.
+	QueryLogMaxBackups int
+	// RateLimit is the maximum number of queries per second from each client,
+	// zero disables rate limiting.
+	RateLimit float64
+	// RateLimitBurst is the maximum burst of queries from each client, if zero
+	// twice the rate limit is used.
+	RateLimitBurst int
+	// MaxConcurrentQueries is the maximum number of concurrent queries from
+	// each client, zero means no limit.
+	MaxConcurrentQueries int
+	// ForwardClientSubnet enables forwarding the EDNS Client Subnet option
+	// from clients to upstream servers, by default it is stripped.
+	ForwardClientSubnet bool
+	// EnableDoT enables serving DNS-over-TLS (RFC 7858) queries.
+	EnableDoT bool
+	// EnableDoH enables serving DNS-over-HTTPS (RFC 8484) queries.
+	EnableDoH bool
+	// TLSCertFile is the path to the TLS certificate to use for
+	// DNS-over-TLS/HTTPS.
+	TLSCertFile string
+	// TLSKeyFile is the path to the TLS private key to use for
+	// DNS-over-TLS/HTTPS.
+	TLSKeyFile string
+	// EnableDNSSEC enables DNSSEC validation of answers from the public
+	// upstream servers.
+	EnableDNSSEC bool
+	// TrustAnchorFile is the path to a zone file containing the DNSSEC trust
+	// anchors (DS or DNSKEY records), eg. for the root zone.
+	TrustAnchorFile string
+}
 
 // DNSService is a DNS service that provides recursive and authoritative DNS resolution.
 type DNSService struct {
+	listenAddrs           []string
+	hostListenAddrs       []string
 	enableNAT64           bool
 	nat64Prefix           netip.Prefix
 	publicUpstreamServers []string
+	healthCheckInterval   time.Duration
+	forwardZones          []string
+	cache                 *dnsCache
+	recordFiles           []string
+	records               []string
+	blocklists            []string
+	blocklistSinkhole     []netip.Addr
+	blocklistReload       time.Duration
+	queryLogPath          string
+	queryLogMaxSize       int
+	queryLogMaxBackups    int
+	rateLimit             float64
+	rateLimitBurst        int
+	maxConcurrentQueries  int
+	forwardClientSubnet   bool
+	enableDoT             bool
+	enableDoH             bool
+	tlsCertFile           string
+	tlsKeyFile            string
+	enableDNSSEC          bool
+	trustAnchorFile       string
+	reverseRecords        atomic.Pointer[reverseRecords]
 }
 
 // DNS returns a new DNS service.
-func DNS(enableNAT64 bool, nat64Prefix netip.Prefix, publicUpstreamServers []string) *DNSService {
-	return &DNSService{
-		enableNAT64:           enableNAT64,
-		nat64Prefix:           nat64Prefix,
-		publicUpstreamServers: publicUpstreamServers,
+func DNS(conf DNSServiceConfig) *DNSService {
+	s := &DNSService{
+		listenAddrs:           conf.ListenAddresses,
+		hostListenAddrs:       conf.HostListenAddresses,
+		enableNAT64:           conf.EnableNAT64,
+		nat64Prefix:           conf.NAT64Prefix,
+		publicUpstreamServers: conf.PublicUpstreamServers,
+		healthCheckInterval:   conf.HealthCheckInterval,
+		forwardZones:          conf.ForwardZones,
+		recordFiles:           conf.RecordFiles,
+		records:               conf.Records,
+		blocklists:            conf.Blocklists,
+		blocklistSinkhole:     conf.BlocklistSinkhole,
+		blocklistReload:       conf.BlocklistReload,
+		queryLogPath:          conf.QueryLogPath,
+		queryLogMaxSize:       conf.QueryLogMaxSize,
+		queryLogMaxBackups:    conf.QueryLogMaxBackups,
+		rateLimit:             conf.RateLimit,
+		rateLimitBurst:        conf.RateLimitBurst,
+		maxConcurrentQueries:  conf.MaxConcurrentQueries,
+		forwardClientSubnet:   conf.ForwardClientSubnet,
+		enableDoT:             conf.EnableDoT,
+		enableDoH:             conf.EnableDoH,
+		tlsCertFile:           conf.TLSCertFile,
+		tlsKeyFile:            conf.TLSKeyFile,
+		enableDNSSEC:          conf.EnableDNSSEC,
+		trustAnchorFile:       conf.TrustAnchorFile,
 	}
+
+	if conf.CacheSize > 0 {
+		s.cache = newDNSCache(conf.CacheSize, conf.CacheMinTTL, conf.CacheMaxTTL)
+	}
+
+	return s
+}
+
+func (s *DNSService) Name() string {
+	return "dns"
+}
+
+// SetConfig updates the reverse (PTR) records for the peers in the network.
+func (s *DNSService) SetConfig(conf *latestconfig.Config) {
+	s.reverseRecords.Store(newReverseRecords(conf))
 }
 
 func (s *DNSService) Serve(ctx context.Context, net network.Network) error {
@@ -56,272 +207,293 @@ func (s *DNSService) Serve(ctx context.Context, net network.Network) error {
 
 	slog.Info("Registering recursive DNS handler", slog.String("zone", "."))
 
-	// Use the system resolver as the private resolver.
-	privateResolver, err := resolver.System(nil)
+	// Use the system nameservers as the private upstream.
+	privateUpstream, err := systemUpstream()
 	if err != nil {
-		return fmt.Errorf("failed to get system resolver: %w", err)
+		return fmt.Errorf("failed to get system upstream: %w", err)
 	}
 
 	// Allow overriding the upstream to use for public DNS queries.
-	var publicResolver resolver.Resolver = privateResolver
+	publicUpstream := privateUpstream
+	var healthCheckedUpstream *healthCheckedUpstream
 	if len(s.publicUpstreamServers) > 0 {
 		slog.Info("Using user-defined public upstream resolvers")
 
-		var resolvers []resolver.Resolver
+		var upstreams []upstream
 		for _, server := range s.publicUpstreamServers {
-			var serverAddrPort types.MaybeAddrPort
-			if err := serverAddrPort.UnmarshalText([]byte(server)); err != nil {
+			upstream, err := parseUpstream(server)
+			if err != nil {
 				return fmt.Errorf("failed to parse public upstream server: %w", err)
 			}
 
-			resolvers = append(resolvers, resolver.DNS(resolver.DNSResolverConfig{
-				Server: netip.AddrPort(serverAddrPort),
-			}))
+			upstreams = append(upstreams, upstream)
+		}
+
+		healthCheckedUpstream = newHealthCheckedUpstream(upstreams...)
+
+		// Without active health checks, unhealthy upstreams can only recover
+		// through client queries.
+		if s.healthCheckInterval <= 0 {
+			healthCheckedUpstream.retryInterval = upstreamRetryInterval
+		}
+		publicUpstream = healthCheckedUpstream
+	}
+
+	var validator *dnssecValidator
+	if s.enableDNSSEC {
+		if s.trustAnchorFile == "" {
+			return fmt.Errorf("a trust anchor file is required for DNSSEC validation")
+		}
+
+		anchors, err := loadTrustAnchors(s.trustAnchorFile)
+		if err != nil {
+			return fmt.Errorf("failed to load DNSSEC trust anchors: %w", err)
+		}
+
+		validator = newDNSSECValidator(publicUpstream, anchors)
+
+		slog.Info("Enabling DNSSEC validation", slog.String("trustAnchors", s.trustAnchorFile))
+	}
+
+	forwardZones, err := parseForwardZones(s.forwardZones)
+	if err != nil {
+		return fmt.Errorf("failed to parse forwarding zones: %w", err)
+	}
+
+	for _, zone := range forwardZones {
+		slog.Info("Forwarding DNS zone",
+			slog.String("zone", zone.zone), slog.Any("upstream", zone.upstream))
+	}
+
+	var queryLog *queryLog
+	if s.queryLogPath != "" {
+		queryLog = newQueryLog(s.queryLogPath, s.queryLogMaxSize, s.queryLogMaxBackups, s.peerName)
+		defer queryLog.Close()
+
+		slog.Info("Logging DNS queries", slog.String("path", s.queryLogPath))
+	}
+
+	var blocklists *blocklists
+	if len(s.blocklists) > 0 {
+		blocklists, err = loadBlocklists(s.blocklists, s.blocklistSinkhole)
+		if err != nil {
+			return fmt.Errorf("failed to load DNS blocklists: %w", err)
+		}
+	}
+
+	var records *staticRecords
+	if len(s.recordFiles) > 0 || len(s.records) > 0 {
+		records, err = loadStaticRecords(domain, s.records, s.recordFiles...)
+		if err != nil {
+			return fmt.Errorf("failed to load static DNS records: %w", err)
 		}
 
-		publicResolver = resolver.RoundRobin(resolvers...)
+		slog.Info("Loaded static DNS records", slog.Int("records", records.Len()))
 	}
 
+	// Each question is resolved independently by a chain of middlewares, the
+	// first middleware is the outermost.
+	recursiveMiddlewares := []middleware{recursionMiddleware()}
+	if s.forwardClientSubnet {
+		recursiveMiddlewares = append(recursiveMiddlewares, clientSubnetMiddleware())
+	}
+	if blocklists != nil {
+		recursiveMiddlewares = append(recursiveMiddlewares, policyMiddleware(blocklists))
+	}
+	if s.cache != nil {
+		recursiveMiddlewares = append(recursiveMiddlewares, cacheMiddleware(s.cache))
+	}
 	if s.enableNAT64 {
 		slog.Info("Enabling DNS64", slog.String("prefix", s.nat64Prefix.String()))
 
-		privateResolver = resolver.DNS64(privateResolver, &resolver.DNS64ResolverConfig{
-			Prefix: &s.nat64Prefix,
-		})
+		recursiveMiddlewares = append(recursiveMiddlewares, dns64Middleware(s.nat64Prefix))
+	}
 
-		publicResolver = resolver.DNS64(publicResolver, &resolver.DNS64ResolverConfig{
-			Prefix: &s.nat64Prefix,
-		})
+	recursive := chain(upstreamResolver(forwardZones, publicUpstream, privateUpstream, validator), recursiveMiddlewares...)
+
+	mux.Handle(".", newDNSHandler(ctx, ".", chain(recursive, loggingMiddleware(queryLog))))
+
+	for _, zone := range []string{"in-addr.arpa.", "ip6.arpa."} {
+		slog.Info("Registering reverse DNS handler", slog.String("zone", zone))
+
+		// Addresses outside of the network are resolved recursively.
+		mux.Handle(zone, newDNSHandler(ctx, zone,
+			chain(reverseResolver(s.reverseRecords.Load, recursive), loggingMiddleware(queryLog))))
 	}
 
-	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
-		reply := &dns.Msg{}
-		reply.SetReply(req)
-		reply.RecursionAvailable = true
+	slog.Info("Registering authoritive DNS handler", slog.String("zone", domain))
 
-		logger := slog.With(
-			slog.String("zone", "."),
-			slog.String("remoteAddr", w.RemoteAddr().String()),
-			slog.Int("id", int(req.Id)))
+	mux.Handle(domain, newDNSHandler(ctx, domain,
+		chain(authoritativeResolver(net, domain, records), loggingMiddleware(queryLog))))
 
-		defer func() {
-			if err := w.WriteMsg(reply); err != nil {
-				logger.Error("Failed to write DNS response", slog.Any("error", err))
-			}
-		}()
+	handler := ednsHandler(mux)
+	var limiter *rateLimiter
+	if s.rateLimit > 0 || s.maxConcurrentQueries > 0 {
+		limiter = newRateLimiter(s.rateLimit, s.rateLimitBurst, s.maxConcurrentQueries)
+		handler = limiter.Handler(handler)
 
-		// Make sure the client is asking for a recursive query.
-		if !req.RecursionDesired {
-			logger.Warn("Non-recursive query")
+		slog.Info("Enabling DNS rate limiting",
+			slog.Float64("queriesPerSecond", s.rateLimit),
+			slog.Int("burst", limiter.burst),
+			slog.Int("maxConcurrentQueries", s.maxConcurrentQueries))
+	}
 
-			reply.Rcode = dns.RcodeRefused
-			return
+	listenAddrs := s.listenAddrs
+	if len(listenAddrs) == 0 {
+		listenAddrs = []string{""}
+	}
+
+	var servers []*dns.Server
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}()
+
+	// listen creates UDP and TCP servers for an address, family is an optional
+	// address family suffix (eg. "4" or "6").
+	listen := func(ln listener, family, addr string) error {
+		pc, err := ln.ListenPacket("udp"+family, addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on UDP address %q: %w", addr, err)
 		}
+		closers = append(closers, pc)
 
-		logger.Info("Recursively resolving DNS query")
+		lis, err := ln.Listen("tcp"+family, addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on TCP address %q: %w", addr, err)
+		}
+		closers = append(closers, lis)
 
-		for _, q := range req.Question {
-			logger = logger.With(
-				slog.String("name", q.Name),
-				slog.String("qType", dns.TypeToString[q.Qtype]))
+		// We have to use multiple server instances as we can't serve both UDP
+		// and TCP at the same time on the one server instance.
+		servers = append(servers,
+			&dns.Server{Handler: handler, PacketConn: pc},
+			&dns.Server{Handler: handler, Listener: lis})
 
-			logger.Debug("Received DNS question")
+		slog.Info("Listening for DNS queries", slog.String("address", lis.Addr().String()))
 
-			domain := dns.CanonicalName(q.Name)
-			if domain != "." {
-				domain = strings.TrimRight(domain, ".")
-			}
+		return nil
+	}
 
-			var upstreamResolver resolver.Resolver
-			if _, icann := publicsuffix.PublicSuffix(domain); icann {
-				logger.Debug("Public query")
-				upstreamResolver = publicResolver
-			} else {
-				logger.Debug("Private query")
-				upstreamResolver = privateResolver
-			}
+	// The address families on the network to serve DNS-over-TLS/HTTPS on.
+	var families []string
+	for _, addr := range listenAddrs {
+		addr, err := parseListenAddress(addr, 53)
+		if err != nil {
+			return err
+		}
 
-			addrs, err := upstreamResolver.LookupNetIP(ctx, "ip", q.Name)
-			if err != nil {
-				if strings.Contains(err.Error(), resolver.ErrNoSuchHost.Error()) {
-					reply.Rcode = dns.RcodeNameError
-					return
-				}
+		family, addr, err := meshListenAddress(net, addr)
+		if err != nil {
+			return err
+		}
 
-				logger.Warn("Failed to lookup DNS question", slog.Any("error", err))
-				reply.Rcode = dns.RcodeServerFailure
-				return
-			}
+		if err := listen(net, family, addr); err != nil {
+			return err
+		}
 
-			var ipv4Addrs, ipv6Addrs []stdnet.IP
-			for _, addr := range addrs {
-				if addr.Unmap().Is4() {
-					ipv4Addrs = append(ipv4Addrs, stdnet.IP(addr.Unmap().AsSlice()))
-				} else {
-					ipv6Addrs = append(ipv6Addrs, stdnet.IP(addr.AsSlice()))
-				}
-			}
+		if !slices.Contains(families, family) {
+			families = append(families, family)
+		}
+	}
 
-			switch q.Qtype {
-			case dns.TypeA:
-				logger.Debug("Answering DNS question", slog.Int("answers", len(ipv4Addrs)))
-
-				for _, addr := range ipv4Addrs {
-					reply.Answer = append(reply.Answer, &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   q.Name,
-							Rrtype: dns.TypeA,
-							Class:  dns.ClassINET,
-							// TODO: would be nice to get TTL from the upstream.
-							Ttl: 300,
-						},
-						A: addr,
-					})
-				}
-			case dns.TypeAAAA:
-				logger.Debug("Answering DNS question", slog.Int("answers", len(ipv6Addrs)))
-
-				for _, addr := range ipv6Addrs {
-					reply.Answer = append(reply.Answer, &dns.AAAA{
-						Hdr: dns.RR_Header{
-							Name:   q.Name,
-							Rrtype: dns.TypeAAAA,
-							Class:  dns.ClassINET,
-							// TODO: would be nice to get TTL from the upstream.
-							Ttl: 300,
-						},
-						AAAA: addr,
-					})
-				}
-			default:
-				logger.Warn("Unsupported DNS query type")
+	// Listening on all families covers any specific family, binding both
+	// would fail with "address in use".
+	if slices.Contains(families, "") {
+		families = []string{""}
+	}
 
-				reply.Rcode = dns.RcodeNotImplemented
-			}
+	// Allow processes on the host to resolve names in the network.
+	for _, addr := range s.hostListenAddrs {
+		addr, err := parseListenAddress(addr, 53)
+		if err != nil {
+			return err
 		}
-	})
 
-	slog.Info("Registering authoritive DNS handler", slog.String("zone", domain))
+		if err := listen(hostNetwork{}, "", addr); err != nil {
+			return err
+		}
+	}
 
-	mux.HandleFunc(domain, func(w dns.ResponseWriter, req *dns.Msg) {
-		reply := &dns.Msg{}
-		reply.SetReply(req)
-		reply.Authoritative = true
-		reply.RecursionAvailable = true
+	var tlsConfig *tls.Config
+	if s.enableDoT || s.enableDoH {
+		if s.tlsCertFile == "" || s.tlsKeyFile == "" {
+			return errors.New("a TLS certificate and key are required for DNS-over-TLS/HTTPS")
+		}
 
-		logger := slog.With(
-			slog.String("zone", domain),
-			slog.String("remoteAddr", w.RemoteAddr().String()),
-			slog.Int("id", int(req.Id)))
+		cert, err := tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
 
-		logger.Info("Resolving DNS question")
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
 
-		defer func() {
-			if err := w.WriteMsg(reply); err != nil {
-				logger.Error("Failed to write DNS response", slog.Any("error", err))
+	if s.enableDoT {
+		for _, family := range families {
+			dotLis, err := net.Listen("tcp"+family, ":853")
+			if err != nil {
+				return fmt.Errorf("failed to listen on DNS-over-TLS port: %w", err)
 			}
-		}()
+			closers = append(closers, dotLis)
 
-		for _, q := range req.Question {
-			logger = logger.With(
-				slog.String("name", q.Name),
-				slog.String("qType", dns.TypeToString[q.Qtype]))
+			slog.Info("Listening for DNS-over-TLS queries", slog.String("address", dotLis.Addr().String()))
 
-			logger.Debug("Received DNS question")
+			// For DNS-over-TLS queries.
+			servers = append(servers, &dns.Server{
+				Handler:  handler,
+				Listener: tls.NewListener(dotLis, tlsConfig),
+			})
+		}
+	}
 
-			addrs, err := net.LookupHost(q.Name)
-			if err != nil {
-				if strings.Contains(err.Error(), resolver.ErrNoSuchHost.Error()) {
-					reply.Rcode = dns.RcodeNameError
-					return
-				}
+	g, ctx := errgroup.WithContext(ctx)
 
-				logger.Warn("Failed to lookup DNS question", slog.Any("error", err))
-				reply.Rcode = dns.RcodeServerFailure
-				return
-			}
+	if s.enableDoH {
+		httpMux := http.NewServeMux()
+		httpMux.Handle(dnsQueryPath, &dohHandler{handler: handler})
 
-			var ipv4Addrs, ipv6Addrs []stdnet.IP
-			for _, addr := range addrs {
-				ip := stdnet.ParseIP(addr)
-				if ip == nil {
-					logger.Warn("Failed to parse IP address", slog.String("address", addr))
-					continue
-				}
+		// For DNS-over-HTTPS queries.
+		dohServer := &http.Server{
+			Handler:           httpMux,
+			TLSConfig:         tlsConfig.Clone(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
 
-				if ip.To4() != nil {
-					ipv4Addrs = append(ipv4Addrs, ip)
-				} else {
-					ipv6Addrs = append(ipv6Addrs, ip)
-				}
+		for _, family := range families {
+			dohLis, err := net.Listen("tcp"+family, ":443")
+			if err != nil {
+				return fmt.Errorf("failed to listen on DNS-over-HTTPS port: %w", err)
 			}
+			closers = append(closers, dohLis)
 
-			switch q.Qtype {
-			case dns.TypeA:
-				logger.Debug("Answering DNS question", slog.Int("answers", len(ipv4Addrs)))
-
-				for _, addr := range ipv4Addrs {
-					reply.Answer = append(reply.Answer, &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   q.Name,
-							Rrtype: dns.TypeA,
-							Class:  dns.ClassINET,
-							Ttl:    60,
-						},
-						A: addr,
-					})
-				}
-			case dns.TypeAAAA:
-				logger.Debug("Answering DNS question", slog.Int("answers", len(ipv6Addrs)))
-
-				for _, addr := range ipv6Addrs {
-					reply.Answer = append(reply.Answer, &dns.AAAA{
-						Hdr: dns.RR_Header{
-							Name:   q.Name,
-							Rrtype: dns.TypeAAAA,
-							Class:  dns.ClassINET,
-							Ttl:    60,
-						},
-						AAAA: addr,
-					})
+			slog.Info("Listening for DNS-over-HTTPS queries", slog.String("address", dohLis.Addr().String()))
+
+			g.Go(func() error {
+				if err := dohServer.ServeTLS(dohLis, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					return err
 				}
-			default:
-				logger.Warn("Unsupported DNS query type")
 
-				reply.Rcode = dns.RcodeNotImplemented
-			}
+				return nil
+			})
 		}
-	})
 
-	pc, err := net.ListenPacket("udp", ":53")
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP port: %w", err)
-	}
-	defer pc.Close()
+		g.Go(func() error {
+			<-ctx.Done()
 
-	// For UDP queries.
-	udpServer := &dns.Server{
-		Handler:    mux,
-		PacketConn: pc,
-	}
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
 
-	lis, err := net.Listen("tcp", ":53")
-	if err != nil {
-		return fmt.Errorf("failed to listen on TCP port: %w", err)
-	}
-	defer lis.Close()
-
-	// For TCP queries.
-	tcpServer := &dns.Server{
-		Handler:  mux,
-		Listener: lis,
+			return dohServer.Shutdown(shutdownCtx)
+		})
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
-
-	// We have to use multiple server instances as we can't serve both UDP and TCP
-	// at the same time on the one server instance.
-	for _, srv := range []*dns.Server{udpServer, tcpServer} {
+	for _, srv := range servers {
 		srv := srv
 
 		g.Go(func() error {
@@ -342,7 +514,33 @@ func (s *DNSService) Serve(ctx context.Context, net network.Network) error {
 		})
 	}
 
-	slog.Info("Listening for DNS queries", slog.String("address", lis.Addr().String()))
+	if limiter != nil {
+		g.Go(func() error {
+			limiter.Run(ctx)
+			return nil
+		})
+	}
+
+	if blocklists != nil && s.blocklistReload > 0 {
+		g.Go(func() error {
+			blocklists.Run(ctx, s.blocklistReload)
+			return nil
+		})
+	}
+
+	if healthCheckedUpstream != nil && s.healthCheckInterval > 0 {
+		g.Go(func() error {
+			healthCheckedUpstream.Run(ctx, s.healthCheckInterval)
+			return nil
+		})
+	}
+
+	if s.cache != nil || blocklists != nil || healthCheckedUpstream != nil {
+		g.Go(func() error {
+			s.logStats(ctx, blocklists, healthCheckedUpstream)
+			return nil
+		})
+	}
 
 	if err := g.Wait(); err != nil && !errors.Is(err, context.Canceled) {
 		return fmt.Errorf("failed to serve DNS: %w", err)
@@ -350,3 +548,153 @@ func (s *DNSService) Serve(ctx context.Context, net network.Network) error {
 
 	return nil
 }
+
+// listener listens for connections and packets, eg. on the userspace network.
+type listener interface {
+	Listen(network, address string) (stdnet.Listener, error)
+	ListenPacket(network, address string) (stdnet.PacketConn, error)
+}
+
+// hostNetwork listens on the host network.
+type hostNetwork struct{}
+
+func (hostNetwork) Listen(network, address string) (stdnet.Listener, error) {
+	return stdnet.Listen(network, address)
+}
+
+func (hostNetwork) ListenPacket(network, address string) (stdnet.PacketConn, error) {
+	return stdnet.ListenPacket(network, address)
+}
+
+// parseListenAddress parses a listen address of the form "ip", "ip:port", or
+// ":port", using the default port if none is specified.
+func parseListenAddress(addr string, defaultPort uint16) (string, error) {
+	addr = withDefaultPort(addr, defaultPort)
+
+	host, port, err := stdnet.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid DNS listen address %q: %w", addr, err)
+	}
+
+	if host != "" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid DNS listen address %q: %w", addr, err)
+		}
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid DNS listen port %q: %w", port, err)
+	}
+
+	return addr, nil
+}
+
+// meshListenAddress returns the address family and address to listen on in
+// the network. The userspace network does not support binding to a specific
+// address, so instead we bind to all addresses of the same family. This is
+// only equivalent if the address is the node's only address of that family,
+// so other addresses are rejected rather than silently widening the bind.
+func meshListenAddress(net network.Network, addr string) (string, string, error) {
+	host, port, _ := stdnet.SplitHostPort(addr)
+	if host == "" {
+		return "", addr, nil
+	}
+
+	ip := netip.MustParseAddr(host).Unmap()
+
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get interface addresses: %w", err)
+	}
+
+	var found bool
+	var sameFamily int
+	for _, interfaceAddr := range interfaceAddrs {
+		var addrIP stdnet.IP
+		switch a := interfaceAddr.(type) {
+		case *stdnet.IPAddr:
+			addrIP = a.IP
+		case *stdnet.IPNet:
+			addrIP = a.IP
+		}
+
+		interfaceIP, ok := netip.AddrFromSlice(addrIP)
+		if !ok {
+			continue
+		}
+		interfaceIP = interfaceIP.Unmap()
+
+		if interfaceIP.Is4() == ip.Is4() {
+			sameFamily++
+		}
+
+		if interfaceIP == ip {
+			found = true
+		}
+	}
+	if !found {
+		return "", "", fmt.Errorf("listen address %q is not assigned to this node", host)
+	}
+
+	if sameFamily > 1 {
+		return "", "", fmt.Errorf("listen address %q is not the node's only address of its family, binding to a specific address is not supported", host)
+	}
+
+	if ip.Is4() {
+		return "4", ":" + port, nil
+	}
+
+	return "6", ":" + port, nil
+}
+
+// peerName returns the name of the peer with the given address (if known).
+func (s *DNSService) peerName(addr netip.Addr) string {
+	if reverseRecords := s.reverseRecords.Load(); reverseRecords != nil {
+		return reverseRecords.LookupAddr(addr)
+	}
+
+	return ""
+}
+
+// logStats periodically logs the cache, blocklist, and upstream statistics.
+func (s *DNSService) logStats(ctx context.Context, blocklists *blocklists, upstream *healthCheckedUpstream) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	var lastHits, lastMisses uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if blocklists != nil {
+				blocklists.LogStats()
+			}
+
+			if upstream != nil {
+				upstream.LogStats()
+			}
+
+			if s.cache == nil {
+				continue
+			}
+
+			hits, misses := s.cache.Stats()
+			if hits == lastHits && misses == lastMisses {
+				continue
+			}
+			lastHits, lastMisses = hits, misses
+
+			var hitRatio float64
+			if hits+misses > 0 {
+				hitRatio = float64(hits) / float64(hits+misses)
+			}
+
+			slog.Info("DNS cache statistics",
+				slog.Uint64("hits", hits),
+				slog.Uint64("misses", misses),
+				slog.Float64("hitRatio", hitRatio),
+				slog.Int("entries", s.cache.Len()))
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	stdnet "net"
+	"testing"
+
+	"github.com/noisysockets/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeshListenAddress(t *testing.T) {
+	net := &interfaceAddrsNetwork{addrs: []stdnet.Addr{
+		&stdnet.IPNet{IP: stdnet.ParseIP("100.64.0.1"), Mask: stdnet.CIDRMask(32, 32)},
+		&stdnet.IPNet{IP: stdnet.ParseIP("fd00::1"), Mask: stdnet.CIDRMask(128, 128)},
+		&stdnet.IPNet{IP: stdnet.ParseIP("fd00::2"), Mask: stdnet.CIDRMask(128, 128)},
+	}}
+
+	family, addr, err := meshListenAddress(net, ":53")
+	require.NoError(t, err)
+	require.Equal(t, "", family)
+	require.Equal(t, ":53", addr)
+
+	family, addr, err = meshListenAddress(net, "100.64.0.1:5353")
+	require.NoError(t, err)
+	require.Equal(t, "4", family)
+	require.Equal(t, ":5353", addr)
+
+	// Not assigned to the node.
+	_, _, err = meshListenAddress(net, "100.64.0.2:53")
+	require.Error(t, err)
+
+	// Listening would also bind the node's other IPv6 address.
+	_, _, err = meshListenAddress(net, "[fd00::1]:53")
+	require.Error(t, err)
+}
+
+type interfaceAddrsNetwork struct {
+	network.Network
+	addrs []stdnet.Addr
+}
+
+func (n *interfaceAddrsNetwork) InterfaceAddrs() ([]stdnet.Addr, error) {
+	return n.addrs, nil
+}
@@ -0,0 +1,430 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/noisysockets/noisysockets/types"
+	"github.com/noisysockets/resolver"
+)
+
+// The location of the system DNS configuration.
+const resolvConfPath = "/etc/resolv.conf"
+
+// How long to wait for an upstream server to respond.
+const upstreamTimeout = 5 * time.Second
+
+const (
+	// The media type of DNS messages (RFC 8484).
+	dnsMessageContentType = "application/dns-message"
+	// The default path for DNS-over-HTTPS queries.
+	dnsQueryPath = "/dns-query"
+)
+
+// upstream is a recursive DNS server that queries can be forwarded to.
+type upstream interface {
+	// Exchange sends a query to the upstream and returns its reply.
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+// dnsUpstream is a DNS upstream server using UDP, TCP, or TLS (RFC 7858).
+type dnsUpstream struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+}
+
+// newDNSUpstream returns an upstream for a DNS server, the network is one of
+// "udp" (with fallback to TCP for large responses), "tcp", or "tcp-tls".
+func newDNSUpstream(network, addr string, tlsConfig *tls.Config) *dnsUpstream {
+	return &dnsUpstream{
+		network:   network,
+		addr:      addr,
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (u *dnsUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:       u.network,
+		TLSConfig: u.tlsConfig,
+		Timeout:   upstreamTimeout,
+	}
+
+	reply, _, err := client.ExchangeContext(ctx, req, u.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upstream %s: %w", u, err)
+	}
+
+	// The response didn't fit in a UDP datagram, retry over TCP.
+	if reply.Truncated && u.network == "udp" {
+		client.Net = "tcp"
+
+		reply, _, err = client.ExchangeContext(ctx, req, u.addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query upstream %s: %w", u, err)
+		}
+	}
+
+	return reply, nil
+}
+
+func (u *dnsUpstream) String() string {
+	switch u.network {
+	case "tcp":
+		return "tcp://" + u.addr
+	case "tcp-tls":
+		return "tls://" + u.addr
+	default:
+		return u.addr
+	}
+}
+
+// httpsUpstream is a DNS-over-HTTPS (RFC 8484) upstream server.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSUpstream(url string, tlsConfig *tls.Config) *httpsUpstream {
+	return &httpsUpstream{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				TLSClientConfig:   tlsConfig,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+			Timeout: upstreamTimeout,
+		},
+	}
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// Use a zero ID to make responses more cache friendly (RFC 8484 Section 4.1).
+	req = req.Copy()
+	id := req.Id
+	req.Id = 0
+
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack DNS query: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Accept", dnsMessageContentType)
+	httpReq.Header.Set("Content-Type", dnsMessageContentType)
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query upstream %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query upstream %s: unexpected status: %s", u, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from upstream %s: %w", u, err)
+	}
+
+	reply := &dns.Msg{}
+	if err := reply.Unpack(body); err != nil {
+		return nil, fmt.Errorf("failed to unpack response from upstream %s: %w", u, err)
+	}
+	reply.Id = id
+
+	return reply, nil
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+// parseUpstream parses an upstream server specification. This is either a
+// plain IP address (with an optional port), or a URL with one of the schemes
+// udp://, tcp://, tls:// (DNS-over-TLS) or https:// (DNS-over-HTTPS).
+//
+// TLS upstreams support the following query parameters:
+//   - sni: the server name to use for TLS (defaults to the host).
+//   - pin-sha256: the base64 encoded SHA-256 digest of the servers public key
+//     (SPKI), can be repeated. If set, the certificate chain is not verified.
+func parseUpstream(spec string) (upstream, error) {
+	if !strings.Contains(spec, "://") {
+		var addrPort types.MaybeAddrPort
+		if err := addrPort.UnmarshalText([]byte(spec)); err != nil {
+			return nil, fmt.Errorf("failed to parse upstream address: %w", err)
+		}
+
+		addr := netip.AddrPort(addrPort)
+		if addr.Port() == 0 {
+			addr = netip.AddrPortFrom(addr.Addr(), 53)
+		}
+
+		return newDNSUpstream("udp", addr.String(), nil), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream URL %q is missing a host", spec)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		return newDNSUpstream(u.Scheme, withDefaultPort(u.Host, 53), nil), nil
+	case "tls":
+		tlsConfig, err := upstreamTLSConfig(u)
+		if err != nil {
+			return nil, err
+		}
+
+		return newDNSUpstream("tcp-tls", withDefaultPort(u.Host, 853), tlsConfig), nil
+	case "https":
+		tlsConfig, err := upstreamTLSConfig(u)
+		if err != nil {
+			return nil, err
+		}
+
+		if u.Path == "" {
+			u.Path = dnsQueryPath
+		}
+
+		// Our options aren't part of the DoH endpoint.
+		u.RawQuery = ""
+
+		return newHTTPSUpstream(u.String(), tlsConfig), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+}
+
+// upstreamTLSConfig returns the TLS config for an upstream URL.
+func upstreamTLSConfig(u *url.URL) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if sni := u.Query().Get("sni"); sni != "" {
+		tlsConfig.ServerName = sni
+	}
+
+	var pins [][]byte
+	for _, pin := range u.Query()["pin-sha256"] {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin-sha256 value %q", pin)
+		}
+
+		pins = append(pins, digest)
+	}
+
+	if len(pins) > 0 {
+		// The pinned public key takes the place of the certificate authority.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no peer certificates")
+			}
+
+			digest := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if subtle.ConstantTimeCompare(digest[:], pin) == 1 {
+					return nil
+				}
+			}
+
+			return errors.New("peer certificate does not match any pinned public key")
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// withDefaultPort adds a port to a host if it doesn't already have one.
+func withDefaultPort(host string, port uint16) string {
+	if _, p, err := stdnet.SplitHostPort(host); err == nil && p != "" {
+		return host
+	}
+
+	return stdnet.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(int(port)))
+}
+
+// sequentialUpstream tries each upstream in order until one succeeds.
+type sequentialUpstream struct {
+	upstreams []upstream
+}
+
+func newSequentialUpstream(upstreams ...upstream) upstream {
+	if len(upstreams) == 1 {
+		return upstreams[0]
+	}
+
+	return &sequentialUpstream{upstreams: upstreams}
+}
+
+func (u *sequentialUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return exchangeInOrder(ctx, req, u.upstreams)
+}
+
+func (u *sequentialUpstream) String() string {
+	return joinUpstreams(u.upstreams)
+}
+
+// joinUpstreams returns a comma separated list of upstreams.
+func joinUpstreams(upstreams []upstream) string {
+	names := make([]string, len(upstreams))
+	for i, u := range upstreams {
+		names[i] = fmt.Sprint(u)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// exchangeInOrder tries each upstream in order, returning the first successful
+// reply.
+func exchangeInOrder(ctx context.Context, req *dns.Msg, upstreams []upstream) (*dns.Msg, error) {
+	var errs []error
+	for _, u := range upstreams {
+		reply, err := u.Exchange(ctx, req)
+		if err == nil {
+			return reply, nil
+		}
+
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// resolverUpstream adapts a resolver.Resolver to the upstream interface, it is
+// only able to answer A and AAAA queries.
+type resolverUpstream struct {
+	resolver resolver.Resolver
+}
+
+func (u *resolverUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	reply := &dns.Msg{}
+	reply.SetReply(req)
+	reply.RecursionAvailable = true
+
+	for _, q := range req.Question {
+		var network string
+		switch q.Qtype {
+		case dns.TypeA:
+			network = "ip4"
+		case dns.TypeAAAA:
+			network = "ip6"
+		default:
+			reply.Rcode = dns.RcodeNotImplemented
+			return reply, nil
+		}
+
+		addrs, err := u.resolver.LookupNetIP(ctx, network, q.Name)
+		if err != nil {
+			if strings.Contains(err.Error(), resolver.ErrNoSuchHost.Error()) {
+				// We can't tell the difference between NXDOMAIN and NODATA.
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			hdr := dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: q.Qtype,
+				Class:  dns.ClassINET,
+				// The resolver doesn't expose the upstream TTL.
+				Ttl: 300,
+			}
+
+			if q.Qtype == dns.TypeA {
+				reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: stdnet.IP(addr.Unmap().AsSlice())})
+			} else {
+				reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: stdnet.IP(addr.AsSlice())})
+			}
+		}
+	}
+
+	return reply, nil
+}
+
+// systemUpstream returns an upstream for the system's configured nameservers.
+func systemUpstream() (upstream, error) {
+	clientConf, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		slog.Debug("Failed to read system DNS configuration, falling back to system resolver",
+			slog.Any("error", err))
+
+		// Not all platforms have a resolv.conf (eg. Windows), in which case we
+		// fall back to the system resolver (which only supports A/AAAA queries).
+		systemResolver, err := resolver.System(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get system resolver: %w", err)
+		}
+
+		return &resolverUpstream{resolver: systemResolver}, nil
+	}
+
+	port, err := strconv.ParseUint(clientConf.Port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse system nameserver port %q: %w", clientConf.Port, err)
+	}
+
+	var upstreams []upstream
+	for _, server := range clientConf.Servers {
+		addr, err := netip.ParseAddr(server)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse system nameserver %q: %w", server, err)
+		}
+
+		upstreams = append(upstreams, newDNSUpstream("udp", netip.AddrPortFrom(addr, uint16(port)).String(), nil))
+	}
+
+	if len(upstreams) == 0 {
+		return nil, errors.New("no system nameservers configured")
+	}
+
+	// Like the system resolver, prefer the first nameserver.
+	return newSequentialUpstream(upstreams...), nil
+}
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/noisysockets/network"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	_ Service      = (*ExposeService)(nil)
+	_ Configurable = (*ExposeService)(nil)
+)
+
+// ExposeServiceConfig is the configuration for the expose service.
+type ExposeServiceConfig struct {
+	// Exposes is a list of host addresses to expose to the network, of the form
+	// "[tcp|udp:]listen=target[@peer...]" (eg. "tcp:5432=localhost:5432"). The
+	// protocol defaults to TCP. If any peers are specified (by public key, or by
+	// name with optional wildcards), only those peers can connect.
+	Exposes []string
+}
+
+// ExposeService is a service that exposes addresses on the host network to
+// peers in the network.
+type ExposeService struct {
+	exposes  []string
+	peers    atomic.Pointer[networkPeers]
+	warnings warnThrottle[deniedPeer]
+}
+
+// deniedPeer is a source address that is not allowed to use an exposure.
+type deniedPeer struct {
+	expose string
+	src    netip.Addr
+}
+
+// Expose returns a service that exposes addresses on the host network to peers
+// in the network.
+func Expose(conf ExposeServiceConfig) *ExposeService {
+	return &ExposeService{
+		exposes: conf.Exposes,
+	}
+}
+
+func (s *ExposeService) Name() string {
+	return "expose"
+}
+
+// SetConfig updates the peers that are allowed to connect.
+func (s *ExposeService) SetConfig(conf *latestconfig.Config) {
+	s.peers.Store(newNetworkPeers(conf))
+}
+
+func (s *ExposeService) Serve(ctx context.Context, net network.Network) error {
+	var exposures []exposure
+	for _, expose := range s.exposes {
+		e, err := parseExposure(expose)
+		if err != nil {
+			return err
+		}
+
+		exposures = append(exposures, e)
+	}
+
+	dialer := &stdnet.Dialer{}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	for _, e := range exposures {
+		logger := slog.Default().With(
+			slog.String("proto", e.network),
+			slog.String("target", e.target))
+
+		family, addr, err := meshListenAddress(net, e.listen)
+		if err != nil {
+			return err
+		}
+
+		allowed := func(addr stdnet.Addr) bool {
+			return s.allowed(logger, e, addr)
+		}
+
+		switch e.network {
+		case "tcp":
+			lis, err := net.Listen("tcp"+family, addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on TCP address %q: %w", e.listen, err)
+			}
+			defer lis.Close()
+
+			logger.Info("Exposing address", slog.String("address", lis.Addr().String()))
+
+			lis = &peerFilteredListener{Listener: lis, allowed: allowed}
+
+			g.Go(func() error {
+				return proxyTCP(ctx, logger, lis, dialer.DialContext, e.target)
+			})
+		case "udp":
+			pc, err := net.ListenPacket("udp"+family, addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on UDP address %q: %w", e.listen, err)
+			}
+			defer pc.Close()
+
+			logger.Info("Exposing address", slog.String("address", pc.LocalAddr().String()))
+
+			pc = &peerFilteredPacketConn{PacketConn: pc, allowed: allowed}
+
+			g.Go(func() error {
+				return proxyUDP(ctx, logger, pc, dialer.DialContext, e.target)
+			})
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("failed to expose addresses: %w", err)
+	}
+
+	return nil
+}
+
+// allowed checks if the peer with the given address is allowed to use the
+// exposure.
+func (s *ExposeService) allowed(logger *slog.Logger, e exposure, addr stdnet.Addr) bool {
+	if len(e.peers) == 0 {
+		return true
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	var peer *networkPeer
+	if peers := s.peers.Load(); peers != nil {
+		peer = peers.Lookup(addrPort.Addr())
+	}
+
+	if peer != nil {
+		for _, pattern := range e.peers {
+			if matchPeer(pattern, peer) {
+				return true
+			}
+		}
+
+		logger = logger.With(slog.String("peer", peer.String()))
+	}
+
+	expose := e.network + ":" + e.listen
+	suppressed, ok := s.warnings.Allow(deniedPeer{expose: expose, src: addrPort.Addr().Unmap()})
+	if ok {
+		logger.Warn("Peer not allowed", slog.String("src", addr.String()), slog.Int("suppressed", suppressed))
+	}
+
+	return false
+}
+
+// exposure exposes an address on the host to the network.
+type exposure struct {
+	portForward
+	// peers is an optional list of peer patterns that are allowed to connect.
+	peers []string
+}
+
+// parseExposure parses an exposure of the form "[tcp|udp:]listen=target[@peer...]"
+// (eg. "tcp:5432=localhost:5432@ci-runner@laptop-*").
+func parseExposure(s string) (exposure, error) {
+	spec, peers, hasPeers := strings.Cut(s, "@")
+
+	pf, err := parsePortForward(spec)
+	if err != nil {
+		return exposure{}, err
+	}
+
+	// Names can't be used, as we listen on the network's own addresses.
+	if host, _, _ := stdnet.SplitHostPort(pf.listen); host != "" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return exposure{}, fmt.Errorf("invalid expose %q listen address: %w", s, err)
+		}
+	}
+
+	e := exposure{portForward: pf}
+	if hasPeers {
+		e.peers = strings.Split(peers, "@")
+	}
+
+	for _, pattern := range e.peers {
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			return exposure{}, fmt.Errorf("invalid peer pattern %q", pattern)
+		}
+	}
+
+	return e, nil
+}
+
+// peerFilteredListener only accepts connections from allowed peers.
+type peerFilteredListener struct {
+	stdnet.Listener
+	allowed func(addr stdnet.Addr) bool
+}
+
+func (l *peerFilteredListener) Accept() (stdnet.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+
+		_ = conn.Close()
+	}
+}
+
+// peerFilteredPacketConn only reads datagrams from allowed peers.
+type peerFilteredPacketConn struct {
+	stdnet.PacketConn
+	allowed func(addr stdnet.Addr) bool
+}
+
+func (pc *peerFilteredPacketConn) ReadFrom(p []byte) (int, stdnet.Addr, error) {
+	for {
+		n, addr, err := pc.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if pc.allowed(addr) {
+			return n, addr, nil
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"bytes"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExposure(t *testing.T) {
+	e, err := parseExposure("tcp:5432=localhost:5432")
+	require.NoError(t, err)
+	require.Equal(t, exposure{
+		portForward: portForward{network: "tcp", listen: ":5432", target: "localhost:5432"},
+	}, e)
+
+	e, err = parseExposure("udp:[fd00::1]:53=127.0.0.1:53@ci-runner@laptop-*@ytjlAyfkF+X2u8bq6cOG3OlXCkjombETs/KFILR9ohk=")
+	require.NoError(t, err)
+	require.Equal(t, exposure{
+		portForward: portForward{network: "udp", listen: "[fd00::1]:53", target: "127.0.0.1:53"},
+		peers:       []string{"ci-runner", "laptop-*", "ytjlAyfkF+X2u8bq6cOG3OlXCkjombETs/KFILR9ohk="},
+	}, e)
+
+	for _, expose := range []string{"tcp:localhost:5432=localhost:5432", "tcp:5432=localhost:5432@", "tcp:5432=localhost:5432@[", "tcp:5432"} {
+		_, err := parseExposure(expose)
+		require.Error(t, err, expose)
+	}
+}
+
+func TestExposePeerFiltering(t *testing.T) {
+	s := Expose(ExposeServiceConfig{})
+	s.SetConfig(&latestconfig.Config{
+		Peers: []latestconfig.PeerConfig{
+			{Name: "ci-runner", PublicKey: "7fnQ1eXqnODkRu5DX0Ovb4BJOw+5GkUzSR9k0N+t9Vo=", IPs: []netip.Addr{netip.MustParseAddr("fd00::2")}},
+			{Name: "laptop", PublicKey: "GJKhbeW1HnqSUXq0NFq4hj47e2QV8a4Jf5ulrSLpNVE=", IPs: []netip.Addr{netip.MustParseAddr("fd00::3")}},
+		},
+	})
+
+	e, err := parseExposure("tcp:5432=localhost:5432@ci-runner")
+	require.NoError(t, err)
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	allowed := func(addr stdnet.Addr) bool {
+		return s.allowed(logger, e, addr)
+	}
+
+	allowedAddr := stdnet.UDPAddrFromAddrPort(netip.MustParseAddrPort("[fd00::2]:1234"))
+	deniedAddr := stdnet.UDPAddrFromAddrPort(netip.MustParseAddrPort("[fd00::3]:1234"))
+
+	t.Run("TCP", func(t *testing.T) {
+		logs.Reset()
+
+		lis := &testListener{conns: make(chan stdnet.Conn, 4)}
+		for _, addr := range []stdnet.Addr{deniedAddr, deniedAddr, allowedAddr, deniedAddr} {
+			lis.conns <- newTestConn(t, addr)
+		}
+		close(lis.conns)
+
+		filtered := &peerFilteredListener{Listener: lis, allowed: allowed}
+
+		conn, err := filtered.Accept()
+		require.NoError(t, err)
+		require.Equal(t, allowedAddr, conn.RemoteAddr())
+
+		_, err = filtered.Accept()
+		require.ErrorIs(t, err, stdnet.ErrClosed)
+
+		// Rejected connections are closed, and only warned about once.
+		require.Equal(t, 3, lis.closed)
+		require.Equal(t, 1, strings.Count(logs.String(), "Peer not allowed"))
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		logs.Reset()
+
+		pc := &testPacketConn{datagrams: []testDatagram{
+			{addr: deniedAddr, payload: "denied"},
+			{addr: allowedAddr, payload: "allowed"},
+			{addr: deniedAddr, payload: "denied"},
+		}}
+
+		filtered := &peerFilteredPacketConn{PacketConn: pc, allowed: allowed}
+
+		buf := make([]byte, 64)
+		n, addr, err := filtered.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, allowedAddr, addr)
+		require.Equal(t, "allowed", string(buf[:n]))
+
+		_, _, err = filtered.ReadFrom(buf)
+		require.ErrorIs(t, err, stdnet.ErrClosed)
+
+		// The previous subtest already warned about this peer.
+		require.Zero(t, strings.Count(logs.String(), "Peer not allowed"))
+	})
+}
+
+// testListener returns queued connections.
+type testListener struct {
+	stdnet.Listener
+	conns  chan stdnet.Conn
+	closed int
+}
+
+func (l *testListener) Accept() (stdnet.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, stdnet.ErrClosed
+	}
+
+	conn.(*testConn).onClose = func() {
+		l.closed++
+	}
+
+	return conn, nil
+}
+
+// testConn is a connection from a given remote address.
+type testConn struct {
+	stdnet.Conn
+	remoteAddr stdnet.Addr
+	onClose    func()
+}
+
+func newTestConn(t *testing.T, remoteAddr stdnet.Addr) *testConn {
+	client, server := stdnet.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return &testConn{Conn: server, remoteAddr: remoteAddr}
+}
+
+func (c *testConn) RemoteAddr() stdnet.Addr {
+	return c.remoteAddr
+}
+
+func (c *testConn) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+
+	return c.Conn.Close()
+}
+
+type testDatagram struct {
+	addr    stdnet.Addr
+	payload string
+}
+
+// testPacketConn returns queued datagrams.
+type testPacketConn struct {
+	stdnet.PacketConn
+	datagrams []testDatagram
+}
+
+func (pc *testPacketConn) ReadFrom(p []byte) (int, stdnet.Addr, error) {
+	if len(pc.datagrams) == 0 {
+		return 0, nil, stdnet.ErrClosed
+	}
+
+	d := pc.datagrams[0]
+	pc.datagrams = pc.datagrams[1:]
+
+	return copy(p, d.payload), d.addr, nil
+}
@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"strings"
+
+	"github.com/noisysockets/network"
+	"golang.org/x/sync/errgroup"
+)
+
+var _ Service = (*ForwardService)(nil)
+
+// ForwardServiceConfig is the configuration for the port forwarding service.
+type ForwardServiceConfig struct {
+	// Forwards is a list of ports to forward from the host into the network, of
+	// the form "[tcp|udp:]listen=target" (eg. "tcp:0.0.0.0:8080=api:80"). The
+	// protocol defaults to TCP.
+	Forwards []string
+}
+
+// ForwardService is a service that forwards connections and datagrams from
+// the host network to addresses in the network.
+type ForwardService struct {
+	forwards []string
+}
+
+// Forward returns a service that forwards connections and datagrams from the
+// host network to addresses in the network.
+func Forward(conf ForwardServiceConfig) *ForwardService {
+	return &ForwardService{
+		forwards: conf.Forwards,
+	}
+}
+
+func (s *ForwardService) Name() string {
+	return "forward"
+}
+
+func (s *ForwardService) Serve(ctx context.Context, net network.Network) error {
+	var forwards []portForward
+	for _, forward := range s.forwards {
+		pf, err := parsePortForward(forward)
+		if err != nil {
+			return err
+		}
+
+		forwards = append(forwards, pf)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	for _, pf := range forwards {
+		logger := slog.Default().With(
+			slog.String("proto", pf.network),
+			slog.String("target", pf.target))
+
+		switch pf.network {
+		case "tcp":
+			lis, err := stdnet.Listen("tcp", pf.listen)
+			if err != nil {
+				return fmt.Errorf("failed to listen on TCP address %q: %w", pf.listen, err)
+			}
+			defer lis.Close()
+
+			logger.Info("Forwarding port", slog.String("address", lis.Addr().String()))
+
+			g.Go(func() error {
+				return proxyTCP(ctx, logger, lis, net.DialContext, pf.target)
+			})
+		case "udp":
+			pc, err := stdnet.ListenPacket("udp", pf.listen)
+			if err != nil {
+				return fmt.Errorf("failed to listen on UDP address %q: %w", pf.listen, err)
+			}
+			defer pc.Close()
+
+			logger.Info("Forwarding port", slog.String("address", pc.LocalAddr().String()))
+
+			g.Go(func() error {
+				return proxyUDP(ctx, logger, pc, net.DialContext, pf.target)
+			})
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("failed to forward ports: %w", err)
+	}
+
+	return nil
+}
+
+// portForward forwards a port on the host to a target in the network.
+type portForward struct {
+	// network is either "tcp" or "udp".
+	network string
+	listen  string
+	target  string
+}
+
+// parsePortForward parses a port forward of the form "[tcp|udp:]listen=target"
+// (eg. "tcp:0.0.0.0:8080=api:80", "udp:[::]:5353=[fd00::1]:53"). The listen
+// address can also be a plain port.
+func parsePortForward(s string) (portForward, error) {
+	pf := portForward{network: "tcp"}
+
+	rest := s
+	if proto, after, ok := strings.Cut(s, ":"); ok && (proto == "tcp" || proto == "udp") {
+		pf.network, rest = proto, after
+	}
+
+	var ok bool
+	pf.listen, pf.target, ok = strings.Cut(rest, "=")
+	if !ok {
+		return portForward{}, fmt.Errorf("invalid port forward %q, expected listen=target", s)
+	}
+
+	// A plain port listens on all addresses.
+	if !strings.Contains(pf.listen, ":") {
+		pf.listen = ":" + pf.listen
+	}
+
+	if _, _, err := stdnet.SplitHostPort(pf.listen); err != nil {
+		return portForward{}, fmt.Errorf("invalid port forward %q listen address: %w", s, err)
+	}
+
+	if host, port, err := stdnet.SplitHostPort(pf.target); err != nil || host == "" || port == "" {
+		return portForward{}, fmt.Errorf("invalid port forward %q target address, expected host:port", s)
+	}
+
+	return pf, nil
+}
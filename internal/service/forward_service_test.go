@@ -0,0 +1,41 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		forward  string
+		expected portForward
+	}{
+		{"tcp:0.0.0.0:8080=api:80", portForward{network: "tcp", listen: "0.0.0.0:8080", target: "api:80"}},
+		{"udp:[::]:5353=[fd00::1]:53", portForward{network: "udp", listen: "[::]:5353", target: "[fd00::1]:53"}},
+		{":8080=api.my.nzzy.net:80", portForward{network: "tcp", listen: ":8080", target: "api.my.nzzy.net:80"}},
+		{"udp:5353=127.0.0.1:53", portForward{network: "udp", listen: ":5353", target: "127.0.0.1:53"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.forward, func(t *testing.T) {
+			pf, err := parsePortForward(tt.forward)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, pf)
+		})
+	}
+
+	for _, forward := range []string{"tcp:0.0.0.0:8080", "tcp:8080=api", "tcp::8080=api", "tcp::8080=:80"} {
+		_, err := parsePortForward(forward)
+		require.Error(t, err, forward)
+	}
+}
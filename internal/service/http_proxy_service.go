@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/noisysockets/contextio"
+	"github.com/noisysockets/network"
+	"golang.org/x/sync/errgroup"
+)
+
+var _ Service = (*HTTPProxyService)(nil)
+
+// HTTPProxyServiceConfig is the configuration for the HTTP proxy service.
+type HTTPProxyServiceConfig struct {
+	// ListenAddress is the address on the host to listen for HTTP proxy clients
+	// on (eg. "127.0.0.1:3128").
+	ListenAddress string
+	// AllowNonLoopback allows listening on non-loopback addresses. As the proxy
+	// doesn't support authentication, anyone who can reach the address can use
+	// it to connect to the network.
+	AllowNonLoopback bool
+}
+
+// HTTPProxyService is a HTTP proxy service (supporting both CONNECT and plain
+// HTTP requests) that allows applications on the host to connect to addresses
+// in the network.
+type HTTPProxyService struct {
+	listenAddr       string
+	allowNonLoopback bool
+}
+
+// HTTPProxy returns a HTTP proxy service that allows applications on the host
+// to connect to addresses in the network.
+func HTTPProxy(conf HTTPProxyServiceConfig) *HTTPProxyService {
+	return &HTTPProxyService{
+		listenAddr:       conf.ListenAddress,
+		allowNonLoopback: conf.AllowNonLoopback,
+	}
+}
+
+func (s *HTTPProxyService) Name() string {
+	return "http-proxy"
+}
+
+func (s *HTTPProxyService) Serve(ctx context.Context, net network.Network) error {
+	if err := checkProxyListenAddress(slog.Default(), s.listenAddr, s.allowNonLoopback); err != nil {
+		return err
+	}
+
+	lis, err := stdnet.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on HTTP proxy address %q: %w", s.listenAddr, err)
+	}
+	defer lis.Close()
+
+	slog.Info("Listening for HTTP proxy connections", slog.String("address", lis.Addr().String()))
+
+	srv := &http.Server{
+		Handler:           newHTTPProxy(ctx, slog.Default(), net.DialContext),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		return srv.Shutdown(shutdownCtx)
+	})
+
+	g.Go(func() error {
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("failed to serve HTTP proxy: %w", err)
+	}
+
+	return nil
+}
+
+// httpProxy is a forward HTTP proxy that uses the provided dial function.
+type httpProxy struct {
+	// ctx is cancelled when the proxy is shutting down, as tunnelled
+	// connections are hijacked they are not closed by the server.
+	ctx    context.Context
+	logger *slog.Logger
+	dial   network.DialContextFunc
+	proxy  *httputil.ReverseProxy
+}
+
+func newHTTPProxy(ctx context.Context, logger *slog.Logger, dial network.DialContextFunc) *httpProxy {
+	p := &httpProxy{
+		ctx:    ctx,
+		logger: logger,
+		dial:   dial,
+	}
+
+	p.proxy = &httputil.ReverseProxy{
+		// Requests to a forward proxy already contain the absolute target URL.
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.Header.Del("Proxy-Authorization")
+			pr.Out.Header.Del("Proxy-Connection")
+		},
+		Transport: &http.Transport{
+			DialContext:           dial,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("Failed to forward request",
+				slog.String("src", r.RemoteAddr), slog.String("dst", r.Host), slog.Any("error", err))
+
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return p
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() || (r.URL.Scheme != "http" && r.URL.Scheme != "https") {
+		http.Error(w, "This is a proxy server, requests must use an absolute http URL", http.StatusBadRequest)
+		return
+	}
+
+	p.logger.Info("Forwarding request",
+		slog.String("src", r.RemoteAddr), slog.String("method", r.Method), slog.String("url", r.URL.String()))
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+// connect tunnels a connection to the requested host.
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	logger := p.logger.With(slog.String("src", r.RemoteAddr), slog.String("dst", r.Host))
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	remote, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		logger.Warn("Failed to dial destination", slog.Any("error", err))
+		http.Error(w, "Failed to connect to destination", http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Warn("Failed to hijack connection", slog.Any("error", err))
+		return
+	}
+	defer conn.Close()
+
+	if _, err := rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	// Forward anything the client sent before the tunnel was established.
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		if _, err := remote.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	logger.Info("Forwarding connection")
+	defer logger.Debug("Connection finished")
+
+	if _, err := contextio.SpliceContext(p.ctx, conn, remote, nil); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Warn("Failed to forward connection", slog.Any("error", err))
+	}
+}
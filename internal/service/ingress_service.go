@@ -0,0 +1,493 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/contextio"
+	"github.com/noisysockets/network"
+	"golang.org/x/sync/errgroup"
+)
+
+var _ Service = (*IngressService)(nil)
+
+// IngressServiceConfig is the configuration for the ingress service.
+type IngressServiceConfig struct {
+	// HTTPListenAddress is the address on the host to listen for HTTP requests
+	// on (eg. ":80"). If empty, plain HTTP is not served.
+	HTTPListenAddress string
+	// TLSListenAddress is the address on the host to listen for TLS connections
+	// on (eg. ":443"). If empty, TLS is not served.
+	TLSListenAddress string
+	// Routes is a list of hostnames to route to targets in the network, of the
+	// form "[passthrough:]host=target" (eg. "app.example.com=app:8080"). The
+	// hostname may start with a "*." wildcard. Passthrough routes forward TLS
+	// connections to the target as is, other routes are served over HTTP (and
+	// over TLS using the configured certificates).
+	Routes []string
+	// TLSCertFiles are the paths to the TLS certificates used to terminate TLS
+	// connections.
+	TLSCertFiles []string
+	// TLSKeyFiles are the paths to the TLS private keys matching TLSCertFiles.
+	TLSKeyFiles []string
+}
+
+// IngressService is a service that routes HTTP requests and TLS connections
+// from the host network to targets in the network, based on the requested
+// hostname.
+type IngressService struct {
+	httpListenAddr string
+	tlsListenAddr  string
+	routes         []string
+	tlsCertFiles   []string
+	tlsKeyFiles    []string
+}
+
+// Ingress returns a service that routes HTTP requests and TLS connections from
+// the host network to targets in the network, based on the requested hostname.
+func Ingress(conf IngressServiceConfig) *IngressService {
+	return &IngressService{
+		httpListenAddr: conf.HTTPListenAddress,
+		tlsListenAddr:  conf.TLSListenAddress,
+		routes:         conf.Routes,
+		tlsCertFiles:   conf.TLSCertFiles,
+		tlsKeyFiles:    conf.TLSKeyFiles,
+	}
+}
+
+func (s *IngressService) Name() string {
+	return "ingress"
+}
+
+func (s *IngressService) Serve(ctx context.Context, net network.Network) error {
+	routes, err := parseIngressRoutes(s.routes)
+	if err != nil {
+		return err
+	}
+
+	if len(s.tlsCertFiles) != len(s.tlsKeyFiles) {
+		return fmt.Errorf("expected the same number of TLS certificates and keys")
+	}
+
+	var tlsConfig *tls.Config
+	if len(s.tlsCertFiles) > 0 {
+		tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+
+		for i := range s.tlsCertFiles {
+			cert, err := tls.LoadX509KeyPair(s.tlsCertFiles[i], s.tlsKeyFiles[i])
+			if err != nil {
+				return fmt.Errorf("failed to load TLS certificate %q: %w", s.tlsCertFiles[i], err)
+			}
+
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		}
+	}
+
+	logger := slog.Default()
+
+	srv := &http.Server{
+		Handler:           newIngressProxy(logger, routes, net.DialContext),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		return srv.Shutdown(shutdownCtx)
+	})
+
+	if s.httpListenAddr != "" {
+		lis, err := stdnet.Listen("tcp", s.httpListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on HTTP address %q: %w", s.httpListenAddr, err)
+		}
+		defer lis.Close()
+
+		logger.Info("Listening for HTTP ingress requests", slog.String("address", lis.Addr().String()))
+
+		g.Go(func() error {
+			if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+
+			return nil
+		})
+	}
+
+	if s.tlsListenAddr != "" && (tlsConfig != nil || routes.hasPassthrough()) {
+		lis, err := stdnet.Listen("tcp", s.tlsListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on TLS address %q: %w", s.tlsListenAddr, err)
+		}
+		defer lis.Close()
+
+		logger.Info("Listening for TLS ingress connections", slog.String("address", lis.Addr().String()))
+
+		// Terminated connections are handed over to the HTTP server.
+		terminated := newConnListener(lis.Addr())
+		defer terminated.Close()
+
+		if tlsConfig != nil {
+			g.Go(func() error {
+				if err := srv.Serve(tls.NewListener(terminated, tlsConfig)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					return err
+				}
+
+				return nil
+			})
+		}
+
+		g.Go(func() error {
+			return serveTLSIngress(ctx, logger, lis, routes, tlsConfig != nil, terminated, net.DialContext)
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("failed to serve ingress: %w", err)
+	}
+
+	return nil
+}
+
+// newIngressProxy returns a reverse proxy that routes requests by their Host
+// header.
+func newIngressProxy(logger *slog.Logger, routes ingressRoutes, dial network.DialContextFunc) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The route has already been checked by the handler below.
+			route, _ := routes.Match(requestHost(pr.In), false)
+
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = route.target
+			// Preserve the original Host header for virtual hosting.
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext:           dial,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("Failed to forward request",
+				slog.String("src", r.RemoteAddr), slog.String("host", r.Host), slog.Any("error", err))
+
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := routes.Match(requestHost(r), false)
+		if !ok {
+			logger.Warn("No route for host", slog.String("src", r.RemoteAddr), slog.String("host", r.Host))
+
+			http.Error(w, "No route for host", http.StatusNotFound)
+			return
+		}
+
+		// Requests over a terminated TLS connection must be for the same route
+		// as the server name the connection was established for, otherwise a
+		// client could use one hostname's certificate to reach another route.
+		if r.TLS != nil {
+			if sniRoute, ok := routes.Match(r.TLS.ServerName, false); !ok || sniRoute != route {
+				logger.Warn("Host does not match TLS server name", slog.String("src", r.RemoteAddr),
+					slog.String("host", r.Host), slog.String("serverName", r.TLS.ServerName))
+
+				http.Error(w, "Host does not match TLS server name", http.StatusMisdirectedRequest)
+				return
+			}
+		}
+
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// requestHost returns the hostname of the request, without any port.
+func requestHost(r *http.Request) string {
+	if host, _, err := stdnet.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+
+	return r.Host
+}
+
+// serveTLSIngress accepts TLS connections and routes them by their SNI
+// hostname. Passthrough routes are forwarded to the target as is, other
+// connections are handed to the terminated listener (if TLS termination is
+// enabled).
+func serveTLSIngress(ctx context.Context, logger *slog.Logger, lis stdnet.Listener, routes ingressRoutes,
+	terminate bool, terminated *connListener, dial network.DialContextFunc) error {
+	go func() {
+		<-ctx.Done()
+		_ = lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		go func() {
+			logger := logger.With(slog.String("src", conn.RemoteAddr().String()))
+
+			_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			serverName, conn, err := peekClientHello(conn)
+			if err != nil {
+				logger.Warn("Failed to read TLS client hello", slog.Any("error", err))
+				_ = conn.Close()
+				return
+			}
+			_ = conn.SetReadDeadline(time.Time{})
+
+			logger = logger.With(slog.String("host", serverName))
+
+			if route, ok := routes.Match(serverName, true); ok {
+				defer conn.Close()
+
+				remote, err := dial(ctx, "tcp", route.target)
+				if err != nil {
+					logger.Warn("Failed to dial target", slog.Any("error", err))
+					return
+				}
+				defer remote.Close()
+
+				logger.Info("Forwarding connection", slog.String("target", route.target))
+				defer logger.Debug("Connection finished")
+
+				if _, err := contextio.SpliceContext(ctx, conn, remote, nil); err != nil && !errors.Is(err, context.Canceled) {
+					logger.Warn("Failed to forward connection", slog.Any("error", err))
+				}
+
+				return
+			}
+
+			if !terminate {
+				logger.Warn("No route for host")
+				_ = conn.Close()
+				return
+			}
+
+			terminated.Handoff(conn)
+		}()
+	}
+}
+
+var errClientHelloRead = errors.New("client hello read")
+
+// peekClientHello reads the TLS client hello from the connection, returning
+// the requested server name, and a connection that will replay the bytes
+// that were read.
+func peekClientHello(conn stdnet.Conn) (string, stdnet.Conn, error) {
+	var buf bytes.Buffer
+
+	var serverName string
+	err := tls.Server(&readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	peeked := &prefixedConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+	if !errors.Is(err, errClientHelloRead) {
+		return "", peeked, err
+	}
+
+	return strings.ToLower(serverName), peeked, nil
+}
+
+// readOnlyConn is a connection that discards writes, used to parse the client
+// hello without responding to it.
+type readOnlyConn struct {
+	stdnet.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// prefixedConn is a connection that reads from the given reader.
+type prefixedConn struct {
+	stdnet.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener is a listener that returns connections handed off to it.
+type connListener struct {
+	addr      stdnet.Addr
+	conns     chan stdnet.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr stdnet.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan stdnet.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Handoff passes a connection to the listener, closing the connection if the
+// listener is closed.
+func (l *connListener) Handoff(conn stdnet.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		_ = conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (stdnet.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, stdnet.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *connListener) Addr() stdnet.Addr {
+	return l.addr
+}
+
+// ingressRoute routes a hostname to a target in the network.
+type ingressRoute struct {
+	// host is the lowercase hostname, optionally starting with a "*." wildcard
+	// that matches a single label.
+	host   string
+	target string
+	// passthrough routes forward TLS connections as is.
+	passthrough bool
+}
+
+// parseIngressRoute parses a route of the form "[passthrough:]host=target"
+// (eg. "app.example.com=app:8080", "passthrough:*.example.com=web:443").
+func parseIngressRoute(s string) (ingressRoute, error) {
+	var route ingressRoute
+
+	rest := s
+	if after, ok := strings.CutPrefix(s, "passthrough:"); ok {
+		route.passthrough, rest = true, after
+	}
+
+	host, target, ok := strings.Cut(rest, "=")
+	if !ok || host == "" {
+		return ingressRoute{}, fmt.Errorf("invalid ingress route %q, expected host=target", s)
+	}
+
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.Contains(host, ":") {
+		return ingressRoute{}, fmt.Errorf("invalid ingress route %q hostname", s)
+	}
+
+	if host, port, err := stdnet.SplitHostPort(target); err != nil || host == "" || port == "" {
+		return ingressRoute{}, fmt.Errorf("invalid ingress route %q target address, expected host:port", s)
+	}
+
+	route.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	route.target = target
+
+	return route, nil
+}
+
+// ingressRoutes is a list of routes, exact hostnames take precedence over
+// wildcards.
+type ingressRoutes []ingressRoute
+
+func parseIngressRoutes(routes []string) (ingressRoutes, error) {
+	var parsed ingressRoutes
+	for _, s := range routes {
+		route, err := parseIngressRoute(s)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, route)
+	}
+
+	return parsed, nil
+}
+
+// Match returns the route for the hostname (of the given kind).
+func (routes ingressRoutes) Match(host string, passthrough bool) (ingressRoute, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var wildcard string
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		wildcard = "*." + parent
+	}
+
+	for _, candidate := range []string{host, wildcard} {
+		if candidate == "" {
+			continue
+		}
+
+		for _, route := range routes {
+			if route.passthrough == passthrough && route.host == candidate {
+				return route, true
+			}
+		}
+	}
+
+	return ingressRoute{}, false
+}
+
+func (routes ingressRoutes) hasPassthrough() bool {
+	for _, route := range routes {
+		if route.passthrough {
+			return true
+		}
+	}
+
+	return false
+}
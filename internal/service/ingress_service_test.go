@@ -0,0 +1,264 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngressRoutes(t *testing.T) {
+	routes, err := parseIngressRoutes([]string{
+		"app.example.com=app:8080",
+		"*.Example.com.=web:80",
+		"passthrough:secure.example.com=vault:443",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, ingressRoute{host: "*.example.com", target: "web:80"}, routes[1])
+
+	route, ok := routes.Match("APP.example.com", false)
+	require.True(t, ok)
+	require.Equal(t, "app:8080", route.target)
+
+	route, ok = routes.Match("blog.example.com", false)
+	require.True(t, ok)
+	require.Equal(t, "web:80", route.target)
+
+	_, ok = routes.Match("a.blog.example.com", false)
+	require.False(t, ok)
+
+	route, ok = routes.Match("secure.example.com", true)
+	require.True(t, ok)
+	require.Equal(t, "vault:443", route.target)
+
+	_, ok = routes.Match("app.example.com", true)
+	require.False(t, ok)
+
+	for _, route := range []string{"app.example.com", "=app:80", "app.example.com=app", "app.*.com=app:80", "app.example.com:80=app:80"} {
+		_, err := parseIngressRoute(route)
+		require.Error(t, err, route)
+	}
+}
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := stdnet.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "App.example.com"}).Handshake()
+	}()
+
+	serverName, conn, err := peekClientHello(server)
+	require.NoError(t, err)
+	require.Equal(t, "app.example.com", serverName)
+
+	// The client hello should be replayed.
+	header := make([]byte, 1)
+	_, err = io.ReadFull(conn, header)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x16), header[0])
+}
+
+func TestIngress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	backend := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + " " + r.Host))
+		})
+	}
+
+	appSrv := httptest.NewServer(backend("app"))
+	t.Cleanup(appSrv.Close)
+
+	otherSrv := httptest.NewServer(backend("other"))
+	t.Cleanup(otherSrv.Close)
+
+	secureSrv := httptest.NewTLSServer(backend("secure"))
+	t.Cleanup(secureSrv.Close)
+
+	routes, err := parseIngressRoutes([]string{
+		"app.example.com=" + appSrv.Listener.Addr().String(),
+		"*.other.example.com=" + otherSrv.Listener.Addr().String(),
+		"passthrough:secure.example.com=" + secureSrv.Listener.Addr().String(),
+	})
+	require.NoError(t, err)
+
+	dial := (&stdnet.Dialer{}).DialContext
+	handler := newIngressProxy(slog.Default(), routes, dial)
+
+	// Serve TLS the same way as the ingress service.
+	lis, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	terminated := newConnListener(lis.Addr())
+	t.Cleanup(func() {
+		_ = terminated.Close()
+	})
+
+	cert, roots := generateTestCertificate(t, "app.example.com", "*.other.example.com")
+
+	tlsSrv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	t.Cleanup(func() {
+		_ = tlsSrv.Close()
+	})
+
+	go func() {
+		_ = tlsSrv.Serve(tls.NewListener(terminated, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	}()
+
+	go func() {
+		_ = serveTLSIngress(ctx, slog.Default(), lis, routes, true, terminated, dial)
+	}()
+
+	// A client that connects to the ingress for every hostname.
+	tlsClient := func(tlsConfig *tls.Config) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (stdnet.Conn, error) {
+					return dial(ctx, network, lis.Addr().String())
+				},
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+
+	get := func(t *testing.T, client *http.Client, url, host string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Host = host
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("HTTP", func(t *testing.T) {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+
+		status, body := get(t, srv.Client(), srv.URL, "App.example.com:80")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "app App.example.com:80", body)
+
+		status, body = get(t, srv.Client(), srv.URL, "www.other.example.com")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "other www.other.example.com", body)
+
+		status, _ = get(t, srv.Client(), srv.URL, "unknown.example.com")
+		require.Equal(t, http.StatusNotFound, status)
+
+		// Passthrough routes are only used for TLS connections.
+		status, _ = get(t, srv.Client(), srv.URL, "secure.example.com")
+		require.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("Passthrough", func(t *testing.T) {
+		// The backend's own certificate is presented, which isn't valid for the
+		// hostname.
+		client := tlsClient(&tls.Config{InsecureSkipVerify: true})
+
+		status, body := get(t, client, "https://secure.example.com", "secure.example.com")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "secure secure.example.com", body)
+	})
+
+	t.Run("Terminated", func(t *testing.T) {
+		client := tlsClient(&tls.Config{RootCAs: roots})
+
+		status, body := get(t, client, "https://app.example.com", "app.example.com")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "app app.example.com", body)
+
+		status, body = get(t, client, "https://www.other.example.com", "www.other.example.com")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "other www.other.example.com", body)
+
+		// Hosts covered by the same route as the server name are allowed.
+		status, body = get(t, client, "https://www.other.example.com", "api.other.example.com")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "other api.other.example.com", body)
+	})
+
+	t.Run("Domain Fronting", func(t *testing.T) {
+		client := tlsClient(&tls.Config{RootCAs: roots})
+
+		status, _ := get(t, client, "https://app.example.com", "www.other.example.com")
+		require.Equal(t, http.StatusMisdirectedRequest, status)
+	})
+
+	t.Run("No Route", func(t *testing.T) {
+		client := tlsClient(&tls.Config{RootCAs: roots})
+
+		status, _ := get(t, client, "https://app.example.com", "unknown.example.com")
+		require.Equal(t, http.StatusNotFound, status)
+	})
+}
+
+// generateTestCertificate returns a self-signed certificate for the given
+// hostnames, and a pool containing it.
+func generateTestCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
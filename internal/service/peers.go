@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"net/netip"
+	"path"
+	"slices"
+
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+)
+
+// networkPeer identifies a peer in the network.
+type networkPeer struct {
+	name      string
+	publicKey string
+}
+
+func (p *networkPeer) String() string {
+	if p.name != "" {
+		return p.name
+	}
+
+	return p.publicKey
+}
+
+// networkPeers maps the addresses of peers back to the peer. Peers can only
+// send packets from their allowed IPs (their own addresses, plus the
+// destinations of any routes via them), so the source address of a packet
+// identifies the peer that sent it.
+type networkPeers struct {
+	// prefixes is sorted by descending prefix length, so that the first match
+	// is the longest.
+	prefixes []peerPrefix
+}
+
+type peerPrefix struct {
+	prefix netip.Prefix
+	peer   *networkPeer
+}
+
+func newNetworkPeers(conf *latestconfig.Config) *networkPeers {
+	p := &networkPeers{}
+
+	peersByName := make(map[string]*networkPeer)
+	for _, peerConf := range conf.Peers {
+		peer := &networkPeer{name: peerConf.Name, publicKey: peerConf.PublicKey}
+		for _, addr := range peerConf.IPs {
+			addr = addr.Unmap()
+			p.prefixes = append(p.prefixes, peerPrefix{prefix: netip.PrefixFrom(addr, addr.BitLen()), peer: peer})
+		}
+
+		if peerConf.Name != "" {
+			peersByName[peerConf.Name] = peer
+		}
+		peersByName[peerConf.PublicKey] = peer
+	}
+
+	for _, routeConf := range conf.Routes {
+		peer, ok := peersByName[routeConf.Via]
+		if !ok {
+			continue
+		}
+
+		p.prefixes = append(p.prefixes, peerPrefix{prefix: routeConf.Destination.Masked(), peer: peer})
+	}
+
+	slices.SortStableFunc(p.prefixes, func(a, b peerPrefix) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+
+	return p
+}
+
+// Lookup returns the peer with the given address (using the longest matching
+// prefix), or nil if there is none.
+func (p *networkPeers) Lookup(addr netip.Addr) *networkPeer {
+	addr = addr.Unmap()
+
+	for _, pp := range p.prefixes {
+		if pp.prefix.Contains(addr) {
+			return pp.peer
+		}
+	}
+
+	return nil
+}
+
+// matchPeer checks if the peer matches a pattern, which is either a public key,
+// or a peer name pattern (eg. "laptop-*").
+func matchPeer(pattern string, peer *networkPeer) bool {
+	if pattern == peer.publicKey {
+		return true
+	}
+
+	if peer.name == "" {
+		return false
+	}
+
+	matched, _ := path.Match(pattern, peer.name)
+	return matched
+}
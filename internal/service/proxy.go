@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/noisysockets/contextio"
+	"github.com/noisysockets/network"
+)
+
+const (
+	// How long to wait without any datagrams before considering a UDP session
+	// dead.
+	udpSessionIdleTimeout = 30 * time.Second
+	// How many datagrams to queue for a UDP session (eg. while dialing).
+	udpSessionQueueSize = 64
+)
+
+// proxyTCP accepts connections from the listener, and proxies them to the
+// target address (until the context is cancelled).
+func proxyTCP(ctx context.Context, logger *slog.Logger, lis stdnet.Listener, dial network.DialContextFunc, target string) error {
+	go func() {
+		<-ctx.Done()
+		_ = lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+
+			logger := logger.With(slog.String("src", conn.RemoteAddr().String()))
+
+			remote, err := dial(ctx, "tcp", target)
+			if err != nil {
+				logger.Warn("Failed to dial target", slog.Any("error", err))
+				return
+			}
+			defer remote.Close()
+
+			logger.Info("Forwarding connection")
+			defer logger.Debug("Connection finished")
+
+			if _, err := contextio.SpliceContext(ctx, conn, remote, nil); err != nil && !errors.Is(err, context.Canceled) {
+				logger.Warn("Failed to forward connection", slog.Any("error", err))
+			}
+		}()
+	}
+}
+
+// proxyUDP reads datagrams from the packet conn, and proxies them to the
+// target address (until the context is cancelled). Each source address gets
+// its own session, so that replies can be sent back to the right client.
+func proxyUDP(ctx context.Context, logger *slog.Logger, pc stdnet.PacketConn, dial network.DialContextFunc, target string) error {
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
+
+	sessions := newUDPSessions(ctx, logger, dial, "src", 0)
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read datagram: %w", err)
+		}
+
+		sessions.Send(addr.String(), target, buf[:n], func(_ stdnet.Addr, reply []byte) error {
+			_, err := pc.WriteTo(reply, addr)
+			return err
+		})
+	}
+}
+
+// udpSessions relays datagrams for a set of UDP sessions, each with its own
+// connection to a target. Targets are dialed in the background so that a slow
+// dial (eg. a DNS lookup) doesn't hold up other sessions, datagrams that
+// arrive in the meantime are queued.
+type udpSessions struct {
+	ctx    context.Context
+	logger *slog.Logger
+	dial   network.DialContextFunc
+	// keyAttr is the name of the log attribute for session keys.
+	keyAttr string
+	// maxSessions is the maximum number of concurrent sessions, zero is
+	// unlimited.
+	maxSessions int
+	mu          sync.Mutex
+	sessions    map[string]*udpSession
+}
+
+type udpSession struct {
+	queue chan []byte
+	// lastActive is the time of the last datagram in either direction (in unix
+	// nanoseconds).
+	lastActive atomic.Int64
+}
+
+func newUDPSessions(ctx context.Context, logger *slog.Logger, dial network.DialContextFunc, keyAttr string, maxSessions int) *udpSessions {
+	return &udpSessions{
+		ctx:         ctx,
+		logger:      logger,
+		dial:        dial,
+		keyAttr:     keyAttr,
+		maxSessions: maxSessions,
+		sessions:    make(map[string]*udpSession),
+	}
+}
+
+// Send forwards a datagram to the target of the session with the given key,
+// starting a new session if needed. Replies are passed to the reply function
+// (along with the address of the target).
+func (s *udpSessions) Send(key, target string, payload []byte, reply func(stdnet.Addr, []byte) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[key]
+	if !ok {
+		if s.maxSessions > 0 && len(s.sessions) >= s.maxSessions {
+			s.logger.Debug("Dropping datagram, too many sessions", slog.String(s.keyAttr, key))
+			return
+		}
+
+		session = &udpSession{queue: make(chan []byte, udpSessionQueueSize)}
+		s.sessions[key] = session
+
+		go s.run(key, target, session, reply)
+	}
+
+	session.lastActive.Store(time.Now().UnixNano())
+
+	select {
+	case session.queue <- bytes.Clone(payload):
+	default:
+		s.logger.Debug("Dropping datagram, session queue is full", slog.String(s.keyAttr, key))
+	}
+}
+
+func (s *udpSessions) run(key, target string, session *udpSession, reply func(stdnet.Addr, []byte) error) {
+	logger := s.logger.With(slog.String(s.keyAttr, key))
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, key)
+		s.mu.Unlock()
+	}()
+
+	remote, err := s.dial(s.ctx, "udp", target)
+	if err != nil {
+		logger.Warn("Failed to dial target", slog.String("target", target), slog.Any("error", err))
+		return
+	}
+	defer remote.Close()
+
+	logger.Info("Forwarding session", slog.String("target", target))
+	defer logger.Debug("Session finished")
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-s.ctx.Done():
+				_ = remote.Close()
+				return
+			case <-done:
+				return
+			case payload := <-session.queue:
+				if _, err := remote.Write(payload); err != nil {
+					logger.Debug("Failed to forward datagram", slog.Any("error", err))
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		lastActive := time.Unix(0, session.lastActive.Load())
+		if err := remote.SetReadDeadline(lastActive.Add(udpSessionIdleTimeout)); err != nil {
+			return
+		}
+
+		n, err := remote.Read(buf)
+		if err != nil {
+			// Datagrams from the client also keep the session alive.
+			if errors.Is(err, os.ErrDeadlineExceeded) &&
+				time.Since(time.Unix(0, session.lastActive.Load())) < udpSessionIdleTimeout {
+				continue
+			}
+
+			return
+		}
+
+		session.lastActive.Store(time.Now().UnixNano())
+
+		if err := reply(remote.RemoteAddr(), buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// checkProxyListenAddress checks that a proxy without authentication only
+// listens on a loopback address, unless allowNonLoopback is set, as otherwise
+// anyone who can reach the host can use it to connect to the network.
+func checkProxyListenAddress(logger *slog.Logger, addr string, allowNonLoopback bool) error {
+	host, _, err := stdnet.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil && ip.IsLoopback() {
+		return nil
+	}
+
+	if !allowNonLoopback {
+		return fmt.Errorf("refusing to listen on non-loopback address %q without authentication, "+
+			"use --proxy-allow-non-loopback to override", addr)
+	}
+
+	logger.Warn("Listening on a non-loopback address without authentication, anyone who can reach it can connect to the network",
+		slog.String("address", addr))
+
+	return nil
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"log/slog"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	echoPC, err := stdnet.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = echoPC.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echoPC.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = echoPC.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// Dials to the slow target block until the test is finished.
+	dial := func(ctx context.Context, network, address string) (stdnet.Conn, error) {
+		if address == "slow.example.com:53" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		return (&stdnet.Dialer{}).DialContext(ctx, network, address)
+	}
+
+	sessions := newUDPSessions(ctx, slog.Default(), dial, "src", 2)
+
+	replies := make(chan string, 10)
+	reply := func(_ stdnet.Addr, b []byte) error {
+		replies <- string(b)
+		return nil
+	}
+
+	sessions.Send("client-1", "slow.example.com:53", []byte("slow"), reply)
+
+	// A slow dial doesn't hold up other sessions, and datagrams sent while
+	// dialing are queued.
+	sessions.Send("client-2", echoPC.LocalAddr().String(), []byte("hello"), reply)
+	sessions.Send("client-2", echoPC.LocalAddr().String(), []byte("world"), reply)
+
+	for _, expected := range []string{"hello", "world"} {
+		select {
+		case got := <-replies:
+			require.Equal(t, expected, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for reply")
+		}
+	}
+
+	// Datagrams for new sessions are dropped when there are too many sessions.
+	sessions.Send("client-3", echoPC.LocalAddr().String(), []byte("dropped"), reply)
+
+	select {
+	case got := <-replies:
+		t.Fatalf("unexpected reply %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCheckProxyListenAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:1080", "[::1]:1080", "localhost:1080"} {
+		require.NoError(t, checkProxyListenAddress(slog.Default(), addr, false), addr)
+	}
+
+	for _, addr := range []string{":1080", "0.0.0.0:1080", "[::]:1080", "192.0.2.1:1080", "proxy.example.com:1080"} {
+		require.Error(t, checkProxyListenAddress(slog.Default(), addr, false), addr)
+		require.NoError(t, checkProxyListenAddress(slog.Default(), addr, true), addr)
+	}
+}
@@ -0,0 +1,315 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/noisysockets/netstack/pkg/tcpip/stack"
+	"github.com/noisysockets/network"
+)
+
+var _ network.Forwarder = (*policyForwarder)(nil)
+
+// policyForwarder wraps a forwarder, only forwarding sessions to destinations
+// that are allowed by the policy.
+type policyForwarder struct {
+	network.Forwarder
+	logger      *slog.Logger
+	policy      *destinationPolicy
+	peers       func() *networkPeers
+	enableNAT64 bool
+	nat64Prefix netip.Prefix
+	warnings    warnThrottle[deniedSession]
+}
+
+type deniedSession struct {
+	proto string
+	src   netip.Addr
+	dst   netip.Addr
+}
+
+func (f *policyForwarder) TCPProtocolHandler(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+	if !f.allowed("tcp", id, id.LocalPort) {
+		return false
+	}
+
+	return f.Forwarder.TCPProtocolHandler(id, pkt)
+}
+
+func (f *policyForwarder) UDPProtocolHandler(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+	if !f.allowed("udp", id, id.LocalPort) {
+		return false
+	}
+
+	return f.Forwarder.UDPProtocolHandler(id, pkt)
+}
+
+func (f *policyForwarder) ICMPv4ProtocolHandler(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+	if !f.allowed("icmp4", id, 0) {
+		return false
+	}
+
+	return f.Forwarder.ICMPv4ProtocolHandler(id, pkt)
+}
+
+func (f *policyForwarder) ICMPv6ProtocolHandler(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+	if !f.allowed("icmp6", id, 0) {
+		return false
+	}
+
+	return f.Forwarder.ICMPv6ProtocolHandler(id, pkt)
+}
+
+// allowed checks if a session is allowed by the policy, port is zero for
+// protocols without ports (eg. ICMP).
+func (f *policyForwarder) allowed(proto string, id stack.TransportEndpointID, port uint16) bool {
+	dstAddr, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+
+	// Apply the policy to the real destination of NAT64 sessions.
+	if f.enableNAT64 && dstAddr.Is6() && f.nat64Prefix.Contains(dstAddr) {
+		dstAddr = netip.AddrFrom4([4]byte(dstAddr.AsSlice()[12:]))
+	}
+
+	srcAddr, _ := netip.AddrFromSlice(id.RemoteAddress.AsSlice())
+
+	var peer *networkPeer
+	if peers := f.peers(); peers != nil {
+		peer = peers.Lookup(srcAddr)
+	}
+
+	if f.policy.Allowed(peer, dstAddr, port) {
+		return true
+	}
+
+	suppressed, ok := f.warnings.Allow(deniedSession{proto: proto, src: srcAddr, dst: dstAddr})
+	if !ok {
+		return false
+	}
+
+	logger := f.logger
+	if peer != nil {
+		logger = logger.With(slog.String("peer", peer.String()))
+	}
+
+	logger.Warn("Destination not allowed",
+		slog.String("proto", proto),
+		slog.String("src", netip.AddrPortFrom(srcAddr, id.RemotePort).String()),
+		slog.String("dst", netip.AddrPortFrom(dstAddr, port).String()),
+		slog.Int("suppressed", suppressed))
+
+	return false
+}
+
+// destinationPolicy decides which destinations packets can be forwarded to.
+type destinationPolicy struct {
+	// allowed destinations, if empty all destinations are allowed.
+	allowed []destinationRule
+	// denied destinations, takes precedence over all other rules.
+	denied []destinationRule
+	// peers are the destinations allowed for specific peers, these replace the
+	// allowed destinations for any matching peers.
+	peers []peerRule
+	// defaultDeny denies all destinations for peers without matching rules.
+	defaultDeny bool
+}
+
+// Allowed checks if the destination is allowed for the peer (which is nil if
+// unknown), port is zero for protocols without ports (eg. ICMP).
+func (p *destinationPolicy) Allowed(peer *networkPeer, addr netip.Addr, port uint16) bool {
+	addr = addr.Unmap()
+
+	for _, rule := range p.denied {
+		if rule.Match(addr, port) {
+			return false
+		}
+	}
+
+	if peer != nil {
+		var matchedPeer bool
+		for _, rule := range p.peers {
+			if !rule.MatchPeer(peer) {
+				continue
+			}
+
+			if rule.destination.Match(addr, port) {
+				return true
+			}
+
+			matchedPeer = true
+		}
+
+		if matchedPeer {
+			return false
+		}
+	}
+
+	if p.defaultDeny {
+		return false
+	}
+
+	if len(p.allowed) == 0 {
+		return true
+	}
+
+	for _, rule := range p.allowed {
+		if rule.Match(addr, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerRule allows a peer to reach a destination.
+type peerRule struct {
+	// peer is a public key, or a peer name pattern (eg. "laptop-*").
+	peer        string
+	destination destinationRule
+}
+
+// parsePeerRules parses a list of peer rules of the form "peer=destination"
+// (eg. "ci-runner=10.0.5.0/24:443"), a destination of "*" matches any
+// destination.
+func parsePeerRules(rules []string) ([]peerRule, error) {
+	var parsed []peerRule
+	for _, s := range rules {
+		// Public keys may end with "=" padding, so split on the last "=".
+		i := strings.LastIndexByte(s, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid peer policy %q, expected peer=destination", s)
+		}
+		peer, dst := s[:i], s[i+1:]
+
+		if _, err := path.Match(peer, ""); err != nil {
+			return nil, fmt.Errorf("invalid peer pattern %q: %w", peer, err)
+		}
+
+		dsts := []string{dst}
+		if dst == "*" {
+			dsts = []string{"0.0.0.0/0", "::/0"}
+		}
+
+		for _, dst := range dsts {
+			rule, err := parseDestinationRule(dst)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer policy %q: %w", s, err)
+			}
+
+			parsed = append(parsed, peerRule{peer: peer, destination: rule})
+		}
+	}
+
+	return parsed, nil
+}
+
+// MatchPeer checks if the rule applies to the peer.
+func (r peerRule) MatchPeer(peer *networkPeer) bool {
+	return matchPeer(r.peer, peer)
+}
+
+// destinationRule matches a destination prefix, and optionally a range of ports.
+type destinationRule struct {
+	prefix netip.Prefix
+	// fromPort and toPort are zero if the rule matches any port.
+	fromPort uint16
+	toPort   uint16
+}
+
+// parseDestinationRule parses a destination rule of the form "prefix",
+// "prefix:port", or "prefix:from-to" (eg. "10.0.0.0/8:443", "fd00::/8:8000-8999",
+// "[fd00::1]:53"). A plain address is treated as a single address prefix.
+func parseDestinationRule(s string) (destinationRule, error) {
+	addr, ports := s, ""
+	if strings.HasPrefix(s, "[") {
+		host, port, err := stdnet.SplitHostPort(s)
+		if err != nil {
+			return destinationRule{}, fmt.Errorf("invalid destination %q: %w", s, err)
+		}
+		addr, ports = host, port
+	} else if i := strings.IndexByte(s, '/'); i >= 0 {
+		if j := strings.IndexByte(s[i:], ':'); j >= 0 {
+			addr, ports = s[:i+j], s[i+j+1:]
+		}
+	} else if strings.Count(s, ":") == 1 {
+		addr, ports, _ = strings.Cut(s, ":")
+	}
+
+	var rule destinationRule
+	if strings.Contains(addr, "/") {
+		prefix, err := netip.ParsePrefix(addr)
+		if err != nil {
+			return destinationRule{}, fmt.Errorf("invalid destination %q: %w", s, err)
+		}
+		rule.prefix = prefix.Masked()
+	} else {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil {
+			return destinationRule{}, fmt.Errorf("invalid destination %q: %w", s, err)
+		}
+		rule.prefix = netip.PrefixFrom(ip, ip.BitLen())
+	}
+
+	if ports != "" {
+		from, to, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			to = from
+		}
+
+		fromPort, err := strconv.ParseUint(from, 10, 16)
+		if err != nil || fromPort == 0 {
+			return destinationRule{}, fmt.Errorf("invalid destination port %q", ports)
+		}
+
+		toPort, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || toPort < fromPort {
+			return destinationRule{}, fmt.Errorf("invalid destination port %q", ports)
+		}
+
+		rule.fromPort, rule.toPort = uint16(fromPort), uint16(toPort)
+	}
+
+	return rule, nil
+}
+
+// parseDestinationRules parses a list of destination rules.
+func parseDestinationRules(rules []string) ([]destinationRule, error) {
+	var parsed []destinationRule
+	for _, s := range rules {
+		rule, err := parseDestinationRule(s)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+// Match checks if the rule matches the destination, port is zero for protocols
+// without ports (which are only matched by rules without ports).
+func (r destinationRule) Match(addr netip.Addr, port uint16) bool {
+	if !r.prefix.Contains(addr) {
+		return false
+	}
+
+	if r.fromPort == 0 {
+		return true
+	}
+
+	return port >= r.fromPort && port <= r.toPort
+}
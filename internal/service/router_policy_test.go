@@ -0,0 +1,204 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDestinationRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		expected destinationRule
+	}{
+		{"10.20.0.0/16", destinationRule{prefix: netip.MustParsePrefix("10.20.0.0/16")}},
+		{"10.20.1.1/16", destinationRule{prefix: netip.MustParsePrefix("10.20.0.0/16")}},
+		{"169.254.169.254", destinationRule{prefix: netip.MustParsePrefix("169.254.169.254/32")}},
+		{"10.0.0.1:443", destinationRule{prefix: netip.MustParsePrefix("10.0.0.1/32"), fromPort: 443, toPort: 443}},
+		{"10.0.5.0/24:443", destinationRule{prefix: netip.MustParsePrefix("10.0.5.0/24"), fromPort: 443, toPort: 443}},
+		{"fd00::/8:8000-8999", destinationRule{prefix: netip.MustParsePrefix("fd00::/8"), fromPort: 8000, toPort: 8999}},
+		{"fd00::1", destinationRule{prefix: netip.MustParsePrefix("fd00::1/128")}},
+		{"[fd00::1]:53", destinationRule{prefix: netip.MustParsePrefix("fd00::1/128"), fromPort: 53, toPort: 53}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			rule, err := parseDestinationRule(tt.rule)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, rule)
+		})
+	}
+
+	for _, rule := range []string{"", "example.com", "10.0.0.0/33", "10.0.0.1:0", "10.0.0.1:99999", "10.0.0.0/8:443-80"} {
+		_, err := parseDestinationRule(rule)
+		require.Error(t, err, rule)
+	}
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	mustParse := func(rules ...string) []destinationRule {
+		parsed, err := parseDestinationRules(rules)
+		require.NoError(t, err)
+		return parsed
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		policy := &destinationPolicy{}
+
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("192.0.2.1"), 80))
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("2001:db8::1"), 0))
+	})
+
+	t.Run("Allowed", func(t *testing.T) {
+		policy := &destinationPolicy{allowed: mustParse("10.20.0.0/16", "10.0.5.0/24:443")}
+
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("10.20.1.1"), 22))
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("10.20.1.1"), 0))
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("10.0.5.1"), 443))
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("10.0.5.1"), 80))
+		// Ports only match protocols with ports.
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("10.0.5.1"), 0))
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("192.0.2.1"), 443))
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		policy := &destinationPolicy{
+			denied: mustParse("10.0.0.0/8", "169.254.169.254", "192.168.0.0/16:22"),
+		}
+
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("10.1.2.3"), 443))
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("::ffff:169.254.169.254"), 80))
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("192.168.1.1"), 22))
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("192.168.1.1"), 80))
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("192.168.1.1"), 0))
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("192.0.2.1"), 443))
+	})
+
+	t.Run("Allowed and Denied", func(t *testing.T) {
+		policy := &destinationPolicy{
+			allowed: mustParse("10.0.0.0/8"),
+			denied:  mustParse("10.0.0.1"),
+		}
+
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("10.0.0.2"), 443))
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("10.0.0.1"), 443))
+	})
+}
+
+func TestDestinationPolicyPeers(t *testing.T) {
+	peerRules, err := parsePeerRules([]string{
+		"ci-runner=10.0.5.0/24:443",
+		"laptop-*=*",
+		"ytjlAyfkF+X2u8bq6cOG3OlXCkjombETs/KFILR9ohk==10.0.6.1",
+	})
+	require.NoError(t, err)
+
+	denied, err := parseDestinationRules([]string{"169.254.169.254"})
+	require.NoError(t, err)
+
+	ciRunner := &networkPeer{name: "ci-runner", publicKey: "7fnQ1eXqnODkRu5DX0Ovb4BJOw+5GkUzSR9k0N+t9Vo="}
+	laptop := &networkPeer{name: "laptop-alice", publicKey: "ODr6FHv1MPxn2XbOpvJe+Svdqwr3F5WRXPVKH9JSyV0="}
+	unnamed := &networkPeer{publicKey: "ytjlAyfkF+X2u8bq6cOG3OlXCkjombETs/KFILR9ohk="}
+	other := &networkPeer{name: "other", publicKey: "GJKhbeW1HnqSUXq0NFq4hj47e2QV8a4Jf5ulrSLpNVE="}
+
+	t.Run("Default Allow", func(t *testing.T) {
+		policy := &destinationPolicy{denied: denied, peers: peerRules}
+
+		require.True(t, policy.Allowed(ciRunner, netip.MustParseAddr("10.0.5.1"), 443))
+		require.False(t, policy.Allowed(ciRunner, netip.MustParseAddr("10.0.5.1"), 22))
+		require.False(t, policy.Allowed(ciRunner, netip.MustParseAddr("192.0.2.1"), 443))
+
+		require.True(t, policy.Allowed(laptop, netip.MustParseAddr("192.0.2.1"), 443))
+		require.True(t, policy.Allowed(laptop, netip.MustParseAddr("2001:db8::1"), 0))
+		require.False(t, policy.Allowed(laptop, netip.MustParseAddr("169.254.169.254"), 80))
+
+		require.True(t, policy.Allowed(unnamed, netip.MustParseAddr("10.0.6.1"), 22))
+		require.False(t, policy.Allowed(unnamed, netip.MustParseAddr("10.0.6.2"), 22))
+
+		// Peers without matching rules fall back to the allowed destinations.
+		require.True(t, policy.Allowed(other, netip.MustParseAddr("192.0.2.1"), 443))
+		require.True(t, policy.Allowed(nil, netip.MustParseAddr("192.0.2.1"), 443))
+	})
+
+	t.Run("Default Deny", func(t *testing.T) {
+		policy := &destinationPolicy{denied: denied, peers: peerRules, defaultDeny: true}
+
+		require.True(t, policy.Allowed(ciRunner, netip.MustParseAddr("10.0.5.1"), 443))
+		require.True(t, policy.Allowed(laptop, netip.MustParseAddr("192.0.2.1"), 443))
+		require.False(t, policy.Allowed(other, netip.MustParseAddr("192.0.2.1"), 443))
+		require.False(t, policy.Allowed(nil, netip.MustParseAddr("192.0.2.1"), 443))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, rule := range []string{"ci-runner", "=10.0.0.0/8", "ci-runner=", "[=10.0.0.0/8"} {
+			_, err := parsePeerRules([]string{rule})
+			require.Error(t, err, rule)
+		}
+	})
+}
+
+func TestNetworkPeersRoutedSource(t *testing.T) {
+	peers := newNetworkPeers(&latestconfig.Config{
+		Peers: []latestconfig.PeerConfig{
+			{Name: "ci-runner", PublicKey: "7fnQ1eXqnODkRu5DX0Ovb4BJOw+5GkUzSR9k0N+t9Vo=", IPs: []netip.Addr{netip.MustParseAddr("fd00::2")}},
+			{Name: "gateway", PublicKey: "GJKhbeW1HnqSUXq0NFq4hj47e2QV8a4Jf5ulrSLpNVE=", IPs: []netip.Addr{netip.MustParseAddr("fd00::3")}},
+		},
+		Routes: []latestconfig.RouteConfig{
+			{Destination: netip.MustParsePrefix("10.0.0.0/8"), Via: "gateway"},
+			{Destination: netip.MustParsePrefix("10.1.0.0/16"), Via: "7fnQ1eXqnODkRu5DX0Ovb4BJOw+5GkUzSR9k0N+t9Vo="},
+		},
+	})
+
+	require.Equal(t, "ci-runner", peers.Lookup(netip.MustParseAddr("fd00::2")).String())
+	require.Equal(t, "gateway", peers.Lookup(netip.MustParseAddr("10.2.0.1")).String())
+	// The longest matching prefix wins.
+	require.Equal(t, "ci-runner", peers.Lookup(netip.MustParseAddr("10.1.0.1")).String())
+	require.Equal(t, "ci-runner", peers.Lookup(netip.MustParseAddr("::ffff:10.1.0.1")).String())
+	require.Nil(t, peers.Lookup(netip.MustParseAddr("192.0.2.1")))
+
+	peerRules, err := parsePeerRules([]string{"ci-runner=10.0.5.0/24:443"})
+	require.NoError(t, err)
+
+	policy := &destinationPolicy{peers: peerRules}
+
+	// A packet from a routed source address gets the peer's rules.
+	peer := peers.Lookup(netip.MustParseAddr("10.1.2.3"))
+	require.True(t, policy.Allowed(peer, netip.MustParseAddr("10.0.5.1"), 443))
+	require.False(t, policy.Allowed(peer, netip.MustParseAddr("192.0.2.1"), 443))
+}
+
+func TestPolicyForwarderWarnThrottling(t *testing.T) {
+	f := &policyForwarder{}
+
+	session := deniedSession{proto: "udp", src: netip.MustParseAddr("fd00::2"), dst: netip.MustParseAddr("10.0.0.1")}
+
+	_, ok := f.warnings.Allow(session)
+	require.True(t, ok)
+
+	for range 10 {
+		_, ok = f.warnings.Allow(session)
+		require.False(t, ok)
+	}
+
+	// Other sessions are warned about independently.
+	_, ok = f.warnings.Allow(deniedSession{proto: "udp", src: session.src, dst: netip.MustParseAddr("10.0.0.2")})
+	require.True(t, ok)
+
+	f.warnings.warned[session].lastWarned = time.Now().Add(-warnThrottleInterval)
+
+	suppressed, ok := f.warnings.Allow(session)
+	require.True(t, ok)
+	require.Equal(t, 10, suppressed)
+}
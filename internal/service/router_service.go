@@ -14,34 +14,100 @@ import (
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"sync/atomic"
 
 	"github.com/noisysockets/network"
 	"github.com/noisysockets/network/forwarder"
 	"github.com/noisysockets/noisysockets"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
 )
 
-var _ Service = (*RouterService)(nil)
+var (
+	_ Service      = (*RouterService)(nil)
+	_ Configurable = (*RouterService)(nil)
+)
+
+// RouterServiceConfig is the configuration for the router service.
+type RouterServiceConfig struct {
+	// EnableNAT64 enables NAT64 translation of IPv6 packets to IPv4.
+	EnableNAT64 bool
+	// NAT64Prefix is the prefix used for NAT64 translated addresses.
+	NAT64Prefix netip.Prefix
+	// AllowedDestinations is an optional list of destinations that packets can
+	// be forwarded to (eg. "10.20.0.0/16", "10.0.0.1:443", "fd00::/8:8000-8999"),
+	// by default all destinations are allowed.
+	AllowedDestinations []string
+	// DeniedDestinations is an optional list of destinations that packets will
+	// never be forwarded to (eg. "169.254.169.254"). Takes precedence over
+	// allowed destinations.
+	DeniedDestinations []string
+	// PeerPolicies is an optional list of destinations that specific peers can
+	// forward packets to (eg. "ci-runner=10.0.5.0/24:443", "laptop-*=*"). Peers
+	// are matched by public key, or by name (which may contain wildcards). These
+	// replace the allowed destinations for any matching peers.
+	PeerPolicies []string
+	// DefaultDeny denies forwarding packets from peers without a matching peer
+	// policy.
+	DefaultDeny bool
+}
 
 // RouterService is a service that forwards packets from the source network to
 // the destination network and vice versa.
 type RouterService struct {
-	dstNet      network.Network
-	enableNAT64 bool
-	nat64Prefix netip.Prefix
+	dstNet              network.Network
+	enableNAT64         bool
+	nat64Prefix         netip.Prefix
+	allowedDestinations []string
+	deniedDestinations  []string
+	peerPolicies        []string
+	defaultDeny         bool
+	peers               atomic.Pointer[networkPeers]
 }
 
 // Router returns a service that forwards packets from the source network to
 // the destination network and vice versa.
-func Router(dstNet network.Network, enableNAT64 bool, nat64Prefix netip.Prefix) *RouterService {
+func Router(dstNet network.Network, conf RouterServiceConfig) *RouterService {
 	return &RouterService{
-		dstNet:      dstNet,
-		enableNAT64: enableNAT64,
-		nat64Prefix: nat64Prefix,
+		dstNet:              dstNet,
+		enableNAT64:         conf.EnableNAT64,
+		nat64Prefix:         conf.NAT64Prefix,
+		allowedDestinations: conf.AllowedDestinations,
+		deniedDestinations:  conf.DeniedDestinations,
+		peerPolicies:        conf.PeerPolicies,
+		defaultDeny:         conf.DefaultDeny,
 	}
 }
 
+func (s *RouterService) Name() string {
+	return "router"
+}
+
+// SetConfig updates the peers that policies are applied to.
+func (s *RouterService) SetConfig(conf *latestconfig.Config) {
+	s.peers.Store(newNetworkPeers(conf))
+}
+
 func (s *RouterService) Serve(ctx context.Context, net network.Network) error {
-	slog.Info("Enabling packet forwarding")
+	allowed, err := parseDestinationRules(s.allowedDestinations)
+	if err != nil {
+		return fmt.Errorf("failed to parse allowed destinations: %w", err)
+	}
+
+	denied, err := parseDestinationRules(s.deniedDestinations)
+	if err != nil {
+		return fmt.Errorf("failed to parse denied destinations: %w", err)
+	}
+
+	peerRules, err := parsePeerRules(s.peerPolicies)
+	if err != nil {
+		return fmt.Errorf("failed to parse peer policies: %w", err)
+	}
+
+	slog.Info("Enabling packet forwarding",
+		slog.Any("allowedDestinations", s.allowedDestinations),
+		slog.Any("deniedDestinations", s.deniedDestinations),
+		slog.Any("peerPolicies", s.peerPolicies),
+		slog.Bool("defaultDeny", s.defaultDeny))
 
 	fwdConf := forwarder.ForwarderConfig{
 		AllowedDestinations: []netip.Prefix{
@@ -59,7 +125,21 @@ func (s *RouterService) Serve(ctx context.Context, net network.Network) error {
 	}
 	defer fwd.Close()
 
-	if err := net.(*noisysockets.NoisySocketsNetwork).EnableForwarding(fwd); err != nil {
+	policyFwd := &policyForwarder{
+		Forwarder: fwd,
+		logger:    slog.Default(),
+		policy: &destinationPolicy{
+			allowed:     allowed,
+			denied:      denied,
+			peers:       peerRules,
+			defaultDeny: s.defaultDeny,
+		},
+		peers:       s.peers.Load,
+		enableNAT64: s.enableNAT64,
+		nat64Prefix: s.nat64Prefix,
+	}
+
+	if err := net.(*noisysockets.NoisySocketsNetwork).EnableForwarding(policyFwd); err != nil {
 		return fmt.Errorf("failed to enable packet forwarding: %w", err)
 	}
 
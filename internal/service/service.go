@@ -13,8 +13,18 @@ import (
 	"context"
 
 	"github.com/noisysockets/network"
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
 )
 
 type Service interface {
+	// Name returns a short human readable name for the service.
+	Name() string
 	Serve(ctx context.Context, net network.Network) error
 }
+
+// Configurable is implemented by services that need access to the network
+// config. SetConfig is called before Serve, and again whenever the config is
+// reloaded.
+type Configurable interface {
+	SetConfig(conf *latestconfig.Config)
+}
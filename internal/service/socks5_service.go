@@ -0,0 +1,462 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/noisysockets/contextio"
+	"github.com/noisysockets/network"
+)
+
+var _ Service = (*SOCKS5Service)(nil)
+
+// SOCKS5 protocol constants, see: RFC 1928.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5CommandConnect      = 0x01
+	socks5CommandUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded            = 0x00
+	socks5ReplyGeneralFailure       = 0x01
+	socks5ReplyNetworkUnreachable   = 0x03
+	socks5ReplyHostUnreachable      = 0x04
+	socks5ReplyConnectionRefused    = 0x05
+	socks5ReplyCommandNotSupported  = 0x07
+	socks5ReplyAddrTypeNotSupported = 0x08
+)
+
+const (
+	// How long to wait for a client to send its request.
+	socks5HandshakeTimeout = 10 * time.Second
+	// The maximum number of targets a client can send datagrams to at once
+	// (per association).
+	socks5MaxUDPSessions = 256
+)
+
+// SOCKS5ServiceConfig is the configuration for the SOCKS5 proxy service.
+type SOCKS5ServiceConfig struct {
+	// ListenAddress is the address on the host to listen for SOCKS5 clients on
+	// (eg. "127.0.0.1:1080").
+	ListenAddress string
+	// AllowNonLoopback allows listening on non-loopback addresses. As the proxy
+	// doesn't support authentication, anyone who can reach the address can use
+	// it to connect to the network.
+	AllowNonLoopback bool
+}
+
+// SOCKS5Service is a SOCKS5 proxy service that allows applications on the host
+// to connect to addresses in the network.
+type SOCKS5Service struct {
+	listenAddr       string
+	allowNonLoopback bool
+}
+
+// SOCKS5 returns a SOCKS5 proxy service that allows applications on the host to
+// connect to addresses in the network.
+func SOCKS5(conf SOCKS5ServiceConfig) *SOCKS5Service {
+	return &SOCKS5Service{
+		listenAddr:       conf.ListenAddress,
+		allowNonLoopback: conf.AllowNonLoopback,
+	}
+}
+
+func (s *SOCKS5Service) Name() string {
+	return "socks5"
+}
+
+func (s *SOCKS5Service) Serve(ctx context.Context, net network.Network) error {
+	if err := checkProxyListenAddress(slog.Default(), s.listenAddr, s.allowNonLoopback); err != nil {
+		return err
+	}
+
+	lis, err := stdnet.Listen("tcp", s.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on SOCKS5 address %q: %w", s.listenAddr, err)
+	}
+	defer lis.Close()
+
+	slog.Info("Listening for SOCKS5 connections", slog.String("address", lis.Addr().String()))
+
+	srv := &socks5Server{
+		logger: slog.Default(),
+		dial:   net.DialContext,
+	}
+
+	if err := srv.Serve(ctx, lis); err != nil {
+		return fmt.Errorf("failed to serve SOCKS5: %w", err)
+	}
+
+	return nil
+}
+
+// socks5Server proxies SOCKS5 CONNECT and UDP ASSOCIATE requests using the
+// provided dial function.
+type socks5Server struct {
+	logger *slog.Logger
+	dial   network.DialContextFunc
+}
+
+// Serve accepts SOCKS5 connections from the listener (until the context is
+// cancelled).
+func (srv *socks5Server) Serve(ctx context.Context, lis stdnet.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+
+			logger := srv.logger.With(slog.String("src", conn.RemoteAddr().String()))
+
+			if err := srv.serveConn(ctx, logger, conn); err != nil {
+				logger.Warn("Failed to serve SOCKS5 connection", slog.Any("error", err))
+			}
+		}()
+	}
+}
+
+func (srv *socks5Server) serveConn(ctx context.Context, logger *slog.Logger, conn stdnet.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout)); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+
+	if err := socks5Negotiate(r, conn); err != nil {
+		return err
+	}
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+
+	target, err := readSOCKS5Addr(r)
+	if err != nil {
+		if errors.Is(err, errSOCKS5AddrType) {
+			_ = writeSOCKS5Reply(conn, socks5ReplyAddrTypeNotSupported, nil)
+		}
+
+		return err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	switch hdr[1] {
+	case socks5CommandConnect:
+		return srv.connect(ctx, logger, conn, target)
+	case socks5CommandUDPAssociate:
+		return srv.udpAssociate(ctx, logger, conn, r)
+	default:
+		_ = writeSOCKS5Reply(conn, socks5ReplyCommandNotSupported, nil)
+		return fmt.Errorf("unsupported SOCKS5 command: %d", hdr[1])
+	}
+}
+
+func (srv *socks5Server) connect(ctx context.Context, logger *slog.Logger, conn stdnet.Conn, target string) error {
+	logger = logger.With(slog.String("proto", "tcp"), slog.String("dst", target))
+
+	remote, err := srv.dial(ctx, "tcp", target)
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5ReplyCode(err), nil)
+		return fmt.Errorf("failed to dial %q: %w", target, err)
+	}
+	defer remote.Close()
+
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded, remote.LocalAddr()); err != nil {
+		return err
+	}
+
+	logger.Info("Forwarding connection")
+	defer logger.Debug("Connection finished")
+
+	if _, err := contextio.SpliceContext(ctx, conn, remote, nil); err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("failed to forward connection: %w", err)
+	}
+
+	return nil
+}
+
+// udpAssociate relays datagrams between the client and the network, until the
+// control connection is closed.
+func (srv *socks5Server) udpAssociate(ctx context.Context, logger *slog.Logger, conn stdnet.Conn, r io.Reader) error {
+	logger = logger.With(slog.String("proto", "udp"))
+
+	// Listen on the same address the client connected to.
+	localAddr := conn.LocalAddr().(*stdnet.TCPAddr)
+	pc, err := stdnet.ListenPacket("udp", stdnet.JoinHostPort(localAddr.IP.String(), "0"))
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return fmt.Errorf("failed to listen for datagrams: %w", err)
+	}
+	defer pc.Close()
+
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded, pc.LocalAddr()); err != nil {
+		return err
+	}
+
+	logger.Info("Forwarding datagrams", slog.String("address", pc.LocalAddr().String()))
+	defer logger.Debug("Association finished")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The association ends when the control connection is closed.
+	go func() {
+		defer cancel()
+		_, _ = io.Copy(io.Discard, r)
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
+
+	// Only accept datagrams from the client's address.
+	clientIP := conn.RemoteAddr().(*stdnet.TCPAddr).IP
+
+	var mu sync.Mutex
+	var clientAddr stdnet.Addr
+
+	sessions := newUDPSessions(ctx, logger, srv.dial, "dst", socks5MaxUDPSessions)
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read datagram: %w", err)
+		}
+
+		if udpAddr, ok := addr.(*stdnet.UDPAddr); !ok || !udpAddr.IP.Equal(clientIP) {
+			continue
+		}
+
+		mu.Lock()
+		clientAddr = addr
+		mu.Unlock()
+
+		target, payload, err := parseSOCKS5Datagram(buf[:n])
+		if err != nil {
+			logger.Debug("Dropping invalid datagram", slog.Any("error", err))
+			continue
+		}
+
+		sessions.Send(target, target, payload, func(remoteAddr stdnet.Addr, reply []byte) error {
+			mu.Lock()
+			addr := clientAddr
+			mu.Unlock()
+
+			_, err := pc.WriteTo(append(socks5DatagramHeader(remoteAddr), reply...), addr)
+			return err
+		})
+	}
+}
+
+// socks5Negotiate negotiates the authentication method with the client, only
+// unauthenticated clients are supported.
+func socks5Negotiate(r io.Reader, w io.Writer) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return fmt.Errorf("failed to read authentication methods: %w", err)
+	}
+
+	for _, method := range methods {
+		if method == socks5MethodNoAuth {
+			_, err := w.Write([]byte{socks5Version, socks5MethodNoAuth})
+			return err
+		}
+	}
+
+	_, _ = w.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+
+	return errors.New("no acceptable authentication method")
+}
+
+var errSOCKS5AddrType = errors.New("unsupported address type")
+
+// readSOCKS5Addr reads a SOCKS5 address and port, returning it as a host:port.
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return "", fmt.Errorf("failed to read address type: %w", err)
+	}
+
+	var host string
+	switch addrType[0] {
+	case socks5AddrIPv4:
+		var ip [4]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = netip.AddrFrom4(ip).String()
+	case socks5AddrIPv6:
+		var ip [16]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = netip.AddrFrom16(ip).String()
+	case socks5AddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", fmt.Errorf("failed to read address: %w", err)
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("%w: %d", errSOCKS5AddrType, addrType[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", fmt.Errorf("failed to read port: %w", err)
+	}
+
+	return stdnet.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKS5Addr appends the SOCKS5 encoding of the address (or the
+// unspecified address if it is not an IP address).
+func appendSOCKS5Addr(b []byte, addr stdnet.Addr) []byte {
+	var addrPort netip.AddrPort
+	if addr != nil {
+		addrPort, _ = netip.ParseAddrPort(addr.String())
+	}
+
+	ip := addrPort.Addr().Unmap()
+	switch {
+	case ip.Is4():
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip.AsSlice()...)
+	case ip.Is6():
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.AsSlice()...)
+	default:
+		b = append(b, socks5AddrIPv4, 0, 0, 0, 0)
+	}
+
+	return binary.BigEndian.AppendUint16(b, addrPort.Port())
+}
+
+func writeSOCKS5Reply(w io.Writer, reply byte, addr stdnet.Addr) error {
+	_, err := w.Write(appendSOCKS5Addr([]byte{socks5Version, reply, 0x00}, addr))
+	return err
+}
+
+// socks5ReplyCode returns the SOCKS5 reply code for a dial error.
+func socks5ReplyCode(err error) byte {
+	var dnsErr *stdnet.DNSError
+	if errors.As(err, &dnsErr) || isNoSuchHost(err) {
+		return socks5ReplyHostUnreachable
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, os.ErrDeadlineExceeded):
+		return socks5ReplyHostUnreachable
+	}
+
+	// The userspace network stack only reports errors as strings.
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "connection was refused"):
+		return socks5ReplyConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return socks5ReplyNetworkUnreachable
+	case strings.Contains(msg, "no route to host"), strings.Contains(msg, "host is down"):
+		return socks5ReplyHostUnreachable
+	}
+
+	return socks5ReplyGeneralFailure
+}
+
+// parseSOCKS5Datagram parses a SOCKS5 UDP datagram, returning the target
+// address and payload. Fragmented datagrams are not supported.
+func parseSOCKS5Datagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("datagram too short")
+	}
+
+	if b[2] != 0x00 {
+		return "", nil, errors.New("fragmented datagrams are not supported")
+	}
+
+	r := bytes.NewReader(b[3:])
+	target, err := readSOCKS5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return target, b[len(b)-r.Len():], nil
+}
+
+// socks5DatagramHeader returns the header for datagrams from the address.
+func socks5DatagramHeader(addr stdnet.Addr) []byte {
+	return appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, addr)
+}
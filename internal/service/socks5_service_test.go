@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestSOCKS5Server(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	lis, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &socks5Server{
+		logger: slog.Default(),
+		dial:   (&stdnet.Dialer{}).DialContext,
+	}
+
+	go func() {
+		_ = srv.Serve(ctx, lis)
+	}()
+
+	t.Run("Connect", func(t *testing.T) {
+		echoLis, err := stdnet.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = echoLis.Close()
+		})
+
+		go func() {
+			conn, err := echoLis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = io.Copy(conn, conn)
+		}()
+
+		dialer, err := proxy.SOCKS5("tcp", lis.Addr().String(), nil, proxy.Direct)
+		require.NoError(t, err)
+
+		conn, err := dialer.Dial("tcp", echoLis.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	})
+
+	t.Run("Connect Unreachable", func(t *testing.T) {
+		lis, err := stdnet.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv := &socks5Server{
+			logger: slog.Default(),
+			dial: func(ctx context.Context, network, address string) (stdnet.Conn, error) {
+				return nil, &stdnet.DNSError{Err: "no such host", Name: address, IsNotFound: true}
+			},
+		}
+
+		go func() {
+			_ = srv.Serve(ctx, lis)
+		}()
+
+		dialer, err := proxy.SOCKS5("tcp", lis.Addr().String(), nil, proxy.Direct)
+		require.NoError(t, err)
+
+		_, err = dialer.Dial("tcp", "does-not-exist.invalid:80")
+		require.ErrorContains(t, err, "host unreachable")
+	})
+
+	t.Run("Connect Refused", func(t *testing.T) {
+		// Find a port that nothing is listening on.
+		closedLis, err := stdnet.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closedAddr := closedLis.Addr().String()
+		require.NoError(t, closedLis.Close())
+
+		dialer, err := proxy.SOCKS5("tcp", lis.Addr().String(), nil, proxy.Direct)
+		require.NoError(t, err)
+
+		_, err = dialer.Dial("tcp", closedAddr)
+		require.ErrorContains(t, err, "connection refused")
+	})
+
+	t.Run("UDP Associate", func(t *testing.T) {
+		echoPC, err := stdnet.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = echoPC.Close()
+		})
+
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, addr, err := echoPC.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				_, _ = echoPC.WriteTo(buf[:n], addr)
+			}
+		}()
+
+		conn, err := stdnet.Dial("tcp", lis.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		_, err = conn.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+		require.NoError(t, err)
+
+		method := make([]byte, 2)
+		_, err = io.ReadFull(conn, method)
+		require.NoError(t, err)
+		require.Equal(t, []byte{socks5Version, socks5MethodNoAuth}, method)
+
+		_, err = conn.Write(appendSOCKS5Addr([]byte{socks5Version, socks5CommandUDPAssociate, 0x00}, nil))
+		require.NoError(t, err)
+
+		reply := make([]byte, 3)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		require.Equal(t, byte(socks5ReplySucceeded), reply[1])
+
+		relayAddr, err := readSOCKS5Addr(conn)
+		require.NoError(t, err)
+
+		relay, err := stdnet.Dial("udp", relayAddr)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = relay.Close()
+		})
+
+		echoAddr := echoPC.LocalAddr()
+
+		datagram := append(socks5DatagramHeader(echoAddr), []byte("hello")...)
+		_, err = relay.Write(datagram)
+		require.NoError(t, err)
+
+		require.NoError(t, relay.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		buf := make([]byte, 1500)
+		n, err := relay.Read(buf)
+		require.NoError(t, err)
+
+		target, payload, err := parseSOCKS5Datagram(buf[:n])
+		require.NoError(t, err)
+		require.Equal(t, netip.MustParseAddrPort(echoAddr.String()).String(), target)
+		require.Equal(t, "hello", string(payload))
+	})
+}
+
+func TestSOCKS5ReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code byte
+	}{
+		{&stdnet.DNSError{Err: "no such host", Name: "api", IsNotFound: true}, socks5ReplyHostUnreachable},
+		{&stdnet.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, socks5ReplyConnectionRefused},
+		{&stdnet.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, socks5ReplyNetworkUnreachable},
+		{&stdnet.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, socks5ReplyHostUnreachable},
+		// Errors from the userspace network stack.
+		{&stdnet.OpError{Op: "connect", Net: "tcp", Err: errors.New("connection was refused")}, socks5ReplyConnectionRefused},
+		{&stdnet.OpError{Op: "connect", Net: "tcp", Err: errors.New("network is unreachable")}, socks5ReplyNetworkUnreachable},
+		{&stdnet.OpError{Op: "connect", Net: "tcp", Err: errors.New("no route to host")}, socks5ReplyHostUnreachable},
+		{errors.New("something else"), socks5ReplyGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.code, socks5ReplyCode(tt.err), tt.err.Error())
+	}
+}
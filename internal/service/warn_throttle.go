@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How often to repeat a warning about the same thing (eg. packets from a
+	// source to a denied destination).
+	warnThrottleInterval = time.Minute
+	// How many warnings to keep track of before forgetting about the ones that
+	// haven't been repeated recently.
+	maxThrottledWarnings = 4096
+)
+
+// warnThrottle throttles repeated warnings caused by peers, so that a peer
+// can't flood the logs.
+type warnThrottle[K comparable] struct {
+	mu     sync.Mutex
+	warned map[K]*throttledWarning
+}
+
+type throttledWarning struct {
+	lastWarned time.Time
+	suppressed int
+}
+
+// Allow returns whether to warn about the key, and how many warnings were
+// suppressed since the last one.
+func (t *warnThrottle[K]) Allow(key K) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	if w, ok := t.warned[key]; ok {
+		if now.Sub(w.lastWarned) < warnThrottleInterval {
+			w.suppressed++
+			return 0, false
+		}
+
+		suppressed := w.suppressed
+		w.lastWarned, w.suppressed = now, 0
+		return suppressed, true
+	}
+
+	if t.warned == nil {
+		t.warned = make(map[K]*throttledWarning)
+	}
+
+	if len(t.warned) >= maxThrottledWarnings {
+		for k, w := range t.warned {
+			if now.Sub(w.lastWarned) >= warnThrottleInterval {
+				delete(t.warned, k)
+			}
+		}
+
+		// Everything is being actively warned about, don't track any more.
+		if len(t.warned) >= maxThrottledWarnings {
+			return 0, false
+		}
+	}
+
+	t.warned[key] = &throttledWarning{lastWarned: now}
+	return 0, true
+}
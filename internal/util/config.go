@@ -10,15 +10,19 @@
 package util
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/gofrs/flock"
 	"github.com/noisysockets/noisysockets/config"
 	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	nshconfig "github.com/noisysockets/nsh/internal/config"
+	"gopkg.in/yaml.v3"
 )
 
 // UpdateConfig performs an atomic update on the given config file.
@@ -42,7 +46,7 @@ func UpdateConfig(configPath string, update func(*latestconfig.Config) (*latestc
 		}
 	}()
 
-	configFile, err := os.Open(configPath)
+	confBytes, err := os.ReadFile(configPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return fmt.Errorf("error opening config file: %w", err)
@@ -50,9 +54,15 @@ func UpdateConfig(configPath string, update func(*latestconfig.Config) (*latestc
 	}
 
 	var versionedConf *latestconfig.Config
-	if configFile != nil {
-		conf, err := config.FromYAML(configFile)
-		_ = configFile.Close()
+	// The nsh section isn't part of the Noisy Sockets config, so carry it over.
+	var nshSection *yaml.Node
+	if confBytes != nil {
+		conf, err := config.FromYAML(bytes.NewReader(confBytes))
+		if err != nil {
+			return fmt.Errorf("error parsing config: %w", err)
+		}
+
+		nshSection, err = nshconfig.Section(confBytes)
 		if err != nil {
 			return fmt.Errorf("error parsing config: %w", err)
 		}
@@ -77,15 +87,25 @@ func UpdateConfig(configPath string, update func(*latestconfig.Config) (*latestc
 		return fmt.Errorf("failed to create config directory: %w", err)
 	}
 
-	configFile, err = os.OpenFile(configPath, os.O_CREATE|os.O_WRONLY, 0o400)
+	var buf bytes.Buffer
+	if err := config.ToYAML(&buf, updatedConf); err != nil {
+		return fmt.Errorf("error writing config: %w", err)
+	}
+
+	confBytes, err = nshconfig.WithSection(buf.Bytes(), nshSection)
 	if err != nil {
-		return fmt.Errorf("error opening config file: %w", err)
+		return fmt.Errorf("error writing config: %w", err)
 	}
-	defer configFile.Close()
 
-	if err := config.ToYAML(configFile, updatedConf); err != nil {
+	if err := os.WriteFile(configPath, confBytes, 0o400); err != nil {
 		return fmt.Errorf("error writing config: %w", err)
 	}
 
 	return nil
 }
+
+// ControlSocketPath returns the default control socket path for the given
+// config file, the socket is stored alongside the config file.
+func ControlSocketPath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".sock"
+}
@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 The Noisy Sockets Authors.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package util_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	latestconfig "github.com/noisysockets/noisysockets/config/v1alpha3"
+	nshconfig "github.com/noisysockets/nsh/internal/config"
+	"github.com/noisysockets/nsh/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateConfigKeepsNshSection(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "noisysockets.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`apiVersion: noisysockets.github.com/v1alpha3
+kind: Config
+name: router
+nsh:
+    router:
+        deny:
+            - 169.254.169.254
+`), 0o600))
+
+	err := util.UpdateConfig(configPath, func(conf *latestconfig.Config) (*latestconfig.Config, error) {
+		conf.Name = "renamed"
+		return conf, nil
+	})
+	require.NoError(t, err)
+
+	confBytes, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	require.Contains(t, string(confBytes), "name: renamed")
+
+	nshConf, err := nshconfig.FromYAML(confBytes)
+	require.NoError(t, err)
+	require.Equal(t, []string{"169.254.169.254"}, nshConf.Router.Deny)
+}
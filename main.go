@@ -10,6 +10,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -29,7 +30,9 @@ import (
 	dnscmd "github.com/noisysockets/nsh/cmd/dns"
 	peercmd "github.com/noisysockets/nsh/cmd/peer"
 	routecmd "github.com/noisysockets/nsh/cmd/route"
+	statuscmd "github.com/noisysockets/nsh/cmd/status"
 	upcmd "github.com/noisysockets/nsh/cmd/up"
+	nshconfig "github.com/noisysockets/nsh/internal/config"
 	"github.com/noisysockets/nsh/internal/constants"
 	"github.com/noisysockets/nsh/internal/service"
 	"github.com/noisysockets/nsh/internal/util"
@@ -39,6 +42,7 @@ import (
 
 func main() {
 	var conf configtypes.Config
+	var nshConf *nshconfig.Config
 	configPath, err := xdg.ConfigFile("nsh/noisysockets.yaml")
 	if err != nil {
 		slog.Error("Error getting config file path", slog.Any("error", err))
@@ -59,6 +63,19 @@ func main() {
 		},
 	}
 
+	controlSocketFlag := &cli.StringFlag{
+		Name:  "control-socket",
+		Usage: "Path to the control API socket (defaults to a socket alongside the config file)",
+	}
+
+	controlSocketPath := func(c *cli.Context) string {
+		if path := c.String("control-socket"); path != "" {
+			return path
+		}
+
+		return util.ControlSocketPath(c.String("config"))
+	}
+
 	initLogger := func(c *cli.Context) error {
 		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 			Level: (*slog.Level)(c.Generic("log-level").(*util.LevelFlag)),
@@ -72,7 +89,7 @@ func main() {
 
 		slog.Debug("Loading config", slog.String("path", configPath))
 
-		configFile, err := os.Open(configPath)
+		confBytes, err := os.ReadFile(configPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				return fmt.Errorf("config file %q does not exist, run `nsh config init` to create one", configPath)
@@ -80,9 +97,13 @@ func main() {
 
 			return fmt.Errorf("failed to open config file: %w", err)
 		}
-		defer configFile.Close()
 
-		conf, err = config.FromYAML(configFile)
+		conf, err = config.FromYAML(bytes.NewReader(confBytes))
+		if err != nil {
+			return fmt.Errorf("failed to read config: %w", err)
+		}
+
+		nshConf, err = nshconfig.FromYAML(confBytes)
 		if err != nil {
 			return fmt.Errorf("failed to read config: %w", err)
 		}
@@ -403,6 +424,32 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:  "status",
+				Usage: "Show the status of a running instance",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The output format (table, json, yaml)",
+						Value:   "table",
+					},
+					&cli.BoolFlag{
+						Name:  "probe",
+						Usage: "Probe the reachability of each peer (this will initiate a handshake)",
+					},
+					controlSocketFlag,
+				}, sharedFlags...),
+				Before: beforeAll(initLogger, initTelemetry),
+				After:  shutdownTelemetry,
+				Action: func(c *cli.Context) error {
+					return statuscmd.Status(
+						c.Context,
+						controlSocketPath(c),
+						c.String("output"),
+						c.Bool("probe"))
+				},
+			},
 			{
 				Name:  "up",
 				Usage: "Start Noisy Sockets",
@@ -425,10 +472,175 @@ func main() {
 						Usage: "The DNS64/NAT64 prefix",
 						Value: "64:ff9b::/96",
 					},
+					&cli.StringSliceFlag{
+						Name:  "router-allow",
+						Usage: "Destinations the router can forward packets to (eg. 10.20.0.0/16, 10.0.0.1:443, fd00::/8:8000-8999), defaults to all destinations",
+					},
+					&cli.StringSliceFlag{
+						Name:  "router-deny",
+						Usage: "Destinations the router will never forward packets to (eg. 169.254.169.254), takes precedence over allowed destinations",
+					},
+					&cli.StringSliceFlag{
+						Name:  "router-policy",
+						Usage: "Destinations a peer can forward packets to, by peer name (with optional wildcards) or public key (eg. ci-runner=10.0.5.0/24:443, laptop-*=*)",
+					},
+					&cli.BoolFlag{
+						Name:  "router-default-deny",
+						Usage: "Deny forwarding packets from peers without a matching router policy",
+					},
+					&cli.StringSliceFlag{
+						Name:  "forward",
+						Usage: "Forward a port on the host to an address in the network (eg. tcp:0.0.0.0:8080=api:80, udp:[::]:5353=[fd00::1]:53)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "expose",
+						Usage: "Expose an address on the host to the network, optionally only to specific peers (eg. tcp:5432=localhost:5432, udp:53=127.0.0.1:53@ci-runner@laptop-*)",
+					},
+					&cli.StringFlag{
+						Name:  "enable-socks5",
+						Usage: "Enable SOCKS5 proxy service, listening on the given host address (eg. 127.0.0.1:1080)",
+					},
+					&cli.BoolFlag{
+						Name:  "proxy-allow-non-loopback",
+						Usage: "Allow proxies to listen on non-loopback addresses (anyone who can reach them can connect to the network)",
+					},
+					&cli.StringFlag{
+						Name:  "enable-http-proxy",
+						Usage: "Enable HTTP proxy service, listening on the given host address (eg. 127.0.0.1:3128)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "ingress",
+						Usage: "Route requests for a hostname on the host to a target in the network (eg. app.example.com=app:8080, passthrough:*.example.com=web:443)",
+					},
+					&cli.StringFlag{
+						Name:  "ingress-http-listen",
+						Usage: "Host address to listen for ingress HTTP requests on (empty to disable)",
+						Value: ":80",
+					},
+					&cli.StringFlag{
+						Name:  "ingress-tls-listen",
+						Usage: "Host address to listen for ingress TLS connections on (empty to disable)",
+						Value: ":443",
+					},
+					&cli.StringSliceFlag{
+						Name:  "ingress-tls-cert",
+						Usage: "TLS certificate files to use for terminating ingress TLS connections",
+					},
+					&cli.StringSliceFlag{
+						Name:  "ingress-tls-key",
+						Usage: "TLS private key files to use for terminating ingress TLS connections (in the same order as the certificates)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dns-listen",
+						Usage: "Addresses on the network to listen for DNS queries on (eg. fd00::1, :5353), defaults to port 53 on all addresses",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dns-host-listen",
+						Usage: "Addresses on the host to listen for DNS queries on (eg. 127.0.0.1:5353)",
+					},
 					&cli.StringSliceFlag{
 						Name:  "dns-public-upstream",
-						Usage: "Upstream DNS servers to use for public queries",
+						Usage: "Upstream DNS servers to use for public queries (eg. 1.1.1.1, tls://1.1.1.1, https://dns.google/dns-query)",
+					},
+					&cli.DurationFlag{
+						Name:  "dns-upstream-health-check-interval",
+						Usage: "How often to health check the public upstream DNS servers (0 to disable)",
+						Value: 10 * time.Second,
+					},
+					&cli.StringSliceFlag{
+						Name:  "dns-forward-zone",
+						Usage: "Forward queries for a zone to specific DNS servers (eg. corp.internal=10.0.0.53)",
+					},
+					&cli.IntFlag{
+						Name:  "dns-cache-size",
+						Usage: "Maximum number of DNS responses to cache (0 to disable caching)",
+						Value: 10000,
+					},
+					&cli.DurationFlag{
+						Name:  "dns-cache-min-ttl",
+						Usage: "Minimum time to cache DNS responses for",
+					},
+					&cli.DurationFlag{
+						Name:  "dns-cache-max-ttl",
+						Usage: "Maximum time to cache DNS responses for (0 for no limit)",
+						Value: 24 * time.Hour,
+					},
+					&cli.StringSliceFlag{
+						Name:  "dns-records",
+						Usage: "Zone files containing additional DNS records for the network domain",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dns-blocklist",
+						Usage: "Hosts format or RPZ (.rpz/.zone) files containing names to block",
+					},
+					&cli.StringSliceFlag{
+						Name:  "dns-blocklist-sinkhole",
+						Usage: "Addresses to answer with for blocked names (by default NXDOMAIN is returned)",
+					},
+					&cli.DurationFlag{
+						Name:  "dns-blocklist-reload-interval",
+						Usage: "How often to check blocklists for changes",
+						Value: time.Minute,
+					},
+					&cli.StringFlag{
+						Name:  "dns-query-log",
+						Usage: "Write a JSON lines log of DNS queries to a file (or - for stdout)",
+					},
+					&cli.IntFlag{
+						Name:  "dns-query-log-max-size",
+						Usage: "Size in megabytes at which the DNS query log is rotated",
+						Value: 100,
+					},
+					&cli.IntFlag{
+						Name:  "dns-query-log-max-backups",
+						Usage: "Number of rotated DNS query logs to retain (0 to retain all)",
+						Value: 5,
+					},
+					&cli.Float64Flag{
+						Name:  "dns-rate-limit",
+						Usage: "Maximum number of DNS queries per second from each client (0 to disable)",
+					},
+					&cli.IntFlag{
+						Name:  "dns-rate-limit-burst",
+						Usage: "Maximum burst of DNS queries from each client (defaults to twice the rate limit)",
+					},
+					&cli.IntFlag{
+						Name:  "dns-max-concurrent-queries",
+						Usage: "Maximum number of concurrent DNS queries from each client (0 for no limit)",
+					},
+					&cli.BoolFlag{
+						Name:  "dns-forward-client-subnet",
+						Usage: "Forward the EDNS Client Subnet option to upstream servers (by default it is stripped)",
+					},
+					&cli.BoolFlag{
+						Name:  "dns-dnssec",
+						Usage: "Validate DNSSEC signatures of answers from the public upstream servers",
+					},
+					&cli.StringFlag{
+						Name:  "dns-trust-anchor",
+						Usage: "Zone file containing the DNSSEC trust anchors (DS or DNSKEY records)",
+					},
+					&cli.BoolFlag{
+						Name:  "dns-over-tls",
+						Usage: "Serve DNS-over-TLS queries on port 853",
+					},
+					&cli.BoolFlag{
+						Name:  "dns-over-https",
+						Usage: "Serve DNS-over-HTTPS queries on port 443",
+					},
+					&cli.StringFlag{
+						Name:  "dns-tls-cert",
+						Usage: "TLS certificate file to use for DNS-over-TLS/HTTPS",
+					},
+					&cli.StringFlag{
+						Name:  "dns-tls-key",
+						Usage: "TLS private key file to use for DNS-over-TLS/HTTPS",
+					},
+					&cli.BoolFlag{
+						Name:  "watch-config",
+						Usage: "Automatically reload the config file when it changes (SIGHUP can always be used)",
 					},
+					controlSocketFlag,
 				}, sharedFlags...),
 				Before: beforeAll(initLogger, initTelemetry, loadConfig),
 				After:  shutdownTelemetry,
@@ -443,11 +655,93 @@ func main() {
 					var services []service.Service
 
 					if c.Bool("enable-dns") {
-						services = append(services, service.DNS(enableNAT64, nat64Prefix, c.StringSlice("dns-public-upstream")))
+						var blocklistSinkhole []netip.Addr
+						for _, addrStr := range c.StringSlice("dns-blocklist-sinkhole") {
+							addr, err := netip.ParseAddr(addrStr)
+							if err != nil {
+								return fmt.Errorf("failed to parse blocklist sinkhole address: %w", err)
+							}
+
+							blocklistSinkhole = append(blocklistSinkhole, addr)
+						}
+
+						services = append(services, service.DNS(service.DNSServiceConfig{
+							ListenAddresses:       c.StringSlice("dns-listen"),
+							HostListenAddresses:   c.StringSlice("dns-host-listen"),
+							EnableNAT64:           enableNAT64,
+							NAT64Prefix:           nat64Prefix,
+							PublicUpstreamServers: c.StringSlice("dns-public-upstream"),
+							HealthCheckInterval:   c.Duration("dns-upstream-health-check-interval"),
+							ForwardZones:          append(nshConf.DNS.ForwardZoneSpecs(), c.StringSlice("dns-forward-zone")...),
+							CacheSize:             c.Int("dns-cache-size"),
+							CacheMinTTL:           c.Duration("dns-cache-min-ttl"),
+							CacheMaxTTL:           c.Duration("dns-cache-max-ttl"),
+							RecordFiles:           c.StringSlice("dns-records"),
+							Records:               nshConf.DNS.Records,
+							Blocklists:            c.StringSlice("dns-blocklist"),
+							BlocklistSinkhole:     blocklistSinkhole,
+							BlocklistReload:       c.Duration("dns-blocklist-reload-interval"),
+							QueryLogPath:          c.String("dns-query-log"),
+							QueryLogMaxSize:       c.Int("dns-query-log-max-size"),
+							QueryLogMaxBackups:    c.Int("dns-query-log-max-backups"),
+							RateLimit:             c.Float64("dns-rate-limit"),
+							RateLimitBurst:        c.Int("dns-rate-limit-burst"),
+							MaxConcurrentQueries:  c.Int("dns-max-concurrent-queries"),
+							ForwardClientSubnet:   c.Bool("dns-forward-client-subnet"),
+							EnableDoT:             c.Bool("dns-over-tls"),
+							EnableDoH:             c.Bool("dns-over-https"),
+							TLSCertFile:           c.String("dns-tls-cert"),
+							TLSKeyFile:            c.String("dns-tls-key"),
+							EnableDNSSEC:          c.Bool("dns-dnssec"),
+							TrustAnchorFile:       c.String("dns-trust-anchor"),
+						}))
 					}
 
 					if c.Bool("enable-router") {
-						services = append(services, service.Router(network.Host(), enableNAT64, nat64Prefix))
+						services = append(services, service.Router(network.Host(), service.RouterServiceConfig{
+							EnableNAT64:         enableNAT64,
+							NAT64Prefix:         nat64Prefix,
+							AllowedDestinations: append(nshConf.Router.Allow, c.StringSlice("router-allow")...),
+							DeniedDestinations:  append(nshConf.Router.Deny, c.StringSlice("router-deny")...),
+							PeerPolicies:        append(nshConf.Router.PolicySpecs(), c.StringSlice("router-policy")...),
+							DefaultDeny:         nshConf.Router.DefaultDeny || c.Bool("router-default-deny"),
+						}))
+					}
+
+					if forwards := c.StringSlice("forward"); len(forwards) > 0 {
+						services = append(services, service.Forward(service.ForwardServiceConfig{
+							Forwards: forwards,
+						}))
+					}
+
+					if exposes := c.StringSlice("expose"); len(exposes) > 0 {
+						services = append(services, service.Expose(service.ExposeServiceConfig{
+							Exposes: exposes,
+						}))
+					}
+
+					if addr := c.String("enable-socks5"); addr != "" {
+						services = append(services, service.SOCKS5(service.SOCKS5ServiceConfig{
+							ListenAddress:    addr,
+							AllowNonLoopback: c.Bool("proxy-allow-non-loopback"),
+						}))
+					}
+
+					if addr := c.String("enable-http-proxy"); addr != "" {
+						services = append(services, service.HTTPProxy(service.HTTPProxyServiceConfig{
+							ListenAddress:    addr,
+							AllowNonLoopback: c.Bool("proxy-allow-non-loopback"),
+						}))
+					}
+
+					if routes := c.StringSlice("ingress"); len(routes) > 0 {
+						services = append(services, service.Ingress(service.IngressServiceConfig{
+							HTTPListenAddress: c.String("ingress-http-listen"),
+							TLSListenAddress:  c.String("ingress-tls-listen"),
+							Routes:            routes,
+							TLSCertFiles:      c.StringSlice("ingress-tls-cert"),
+							TLSKeyFiles:       c.StringSlice("ingress-tls-key"),
+						}))
 					}
 
 					// If all services are disabled, then throw an error.
@@ -456,7 +750,13 @@ func main() {
 						return errors.New("at least one service must be enabled")
 					}
 
-					return upcmd.Up(c.Context, conf, services)
+					return upcmd.Up(
+						c.Context,
+						c.String("config"),
+						conf,
+						controlSocketPath(c),
+						c.Bool("watch-config"),
+						services)
 				},
 			},
 		},